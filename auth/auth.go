@@ -0,0 +1,194 @@
+//Package auth 服务端账户，密码或令牌加盐哈希后保存
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Store 账户存储
+type Store interface {
+	//Exists 是否存在该账户
+	Exists(name string) bool
+	//Verify 校验账户的密码或令牌
+	Verify(name, secret string) error
+}
+
+var (
+	ErrNoAccount = errors.New("auth: no such account")
+	ErrSecret    = errors.New("auth: wrong password")
+)
+
+const (
+	saltLen int = 16
+	keyLen  int = 32
+
+	//algorithm 账户文件中记录的哈希算法
+	algorithm = "pbkdf2-sha256"
+	//legacyIterations 旧格式"name salt hash"使用的迭代次数
+	legacyIterations int = 10000
+)
+
+//iterations 新增账户的迭代次数，每行记录各自的次数，提高后已有的账户仍可校验
+var iterations = 600000
+
+type account struct {
+	iterations int
+	salt       []byte
+	hash       []byte
+}
+
+//File 账户文件，每行"name pbkdf2-sha256 iterations salt hash"（十六进制），同名以后出现的为准
+//也接受旧格式"name salt hash"
+type File struct {
+	mu       sync.Mutex
+	path     string
+	accounts map[string]account
+}
+
+//OpenFile 读取账户文件，不存在时视为空
+func OpenFile(path string) (*File, error) {
+	s := &File{path: path, accounts: make(map[string]account)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		a, err := parseAccount(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("auth: %s:%d invalid account: %v", path, line, err)
+		}
+		s.accounts[fields[0]] = a
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//parseAccount 解析账户行中名字之后的字段
+func parseAccount(fields []string) (account, error) {
+	a := account{iterations: legacyIterations}
+	switch len(fields) {
+	case 2:
+	case 4:
+		if fields[0] != algorithm {
+			return a, fmt.Errorf("unsupported algorithm[%s]", fields[0])
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n <= 0 {
+			return a, fmt.Errorf("invalid iterations[%s]", fields[1])
+		}
+		a.iterations = n
+		fields = fields[2:]
+	default:
+		return a, errors.New("wrong number of fields")
+	}
+	var err error
+	if a.salt, err = hex.DecodeString(fields[0]); err != nil {
+		return a, err
+	}
+	a.hash, err = hex.DecodeString(fields[1])
+	return a, err
+}
+
+//Reload 重新读取账户文件，用于外部修改了文件之后，出错时保留原有账户
+func (s *File) Reload() error {
+	f, err := OpenFile(s.path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.accounts = f.accounts
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *File) Exists(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.accounts[name]
+	return ok
+}
+
+func (s *File) Verify(name, secret string) error {
+	s.mu.Lock()
+	a, ok := s.accounts[name]
+	s.mu.Unlock()
+	if !ok {
+		return ErrNoAccount
+	}
+	h, err := hash(secret, a.salt, a.iterations)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(h, a.hash) {
+		return ErrSecret
+	}
+	return nil
+}
+
+//Add 添加账户或修改已有账户的密码，追加写入文件
+func (s *File) Add(name, secret string) error {
+	if len(name) == 0 || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("File.Add: invalid name[%s]", name)
+	}
+	if len(secret) == 0 {
+		return errors.New("File.Add: secret is empty")
+	}
+	a := account{iterations: iterations, salt: make([]byte, saltLen)}
+	if _, err := rand.Read(a.salt); err != nil {
+		return err
+	}
+	var err error
+	if a.hash, err = hash(secret, a.salt, a.iterations); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s %s %d %x %x\n", name, algorithm, a.iterations, a.salt, a.hash)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	s.accounts[name] = a
+	return nil
+}
+
+//NewToken 生成随机令牌，可代替密码用于机器人等账户
+func NewToken() string {
+	var b [24]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+//hash PBKDF2-HMAC-SHA256
+func hash(secret string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, secret, salt, iterations, keyLen)
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+	//减少迭代次数加快测试，每行记录了自己的次数
+	defer func(n int) { iterations = n }(iterations)
+	iterations = 1000
+	path := filepath.Join(t.TempDir(), "users")
+	s, err := OpenFile(path)
+	if err != nil {
+		t.Fatalf("OpenFile error:%v", err)
+	}
+	if s.Exists("tom") {
+		t.Errorf("empty file, tom should not exist")
+	}
+	if err := s.Add("bad name", "pw"); err == nil {
+		t.Errorf("invalid name, want error")
+	}
+	if err := s.Add("tom", ""); err == nil {
+		t.Errorf("empty secret, want error")
+	}
+	token := NewToken()
+	s.Add("tom", "old")
+	s.Add("tom", "秘密")
+	s.Add("bot", token)
+	//旧格式的行没有算法和迭代次数
+	salt := []byte("0123456789abcdef")
+	legacy, _ := hash("旧密码", salt, legacyIterations)
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	fmt.Fprintf(f, "spike %x %x\n", salt, legacy)
+	f.Close()
+	if b, _ := os.ReadFile(path); !strings.HasPrefix(string(b), "tom pbkdf2-sha256 1000 ") {
+		t.Errorf("account line got %q, want algorithm and iterations", b)
+	}
+
+	s, err = OpenFile(path)
+	if err != nil {
+		t.Fatalf("reopen error:%v", err)
+	}
+	tests := []struct {
+		name, secret string
+		want         error
+	}{
+		{"tom", "秘密", nil},
+		{"tom", "old", ErrSecret},
+		{"bot", token, nil},
+		{"bot", "", ErrSecret},
+		{"jerry", "秘密", ErrNoAccount},
+		{"spike", "旧密码", nil},
+		{"spike", "秘密", ErrSecret},
+	}
+	for _, test := range tests {
+		if err := s.Verify(test.name, test.secret); err != test.want {
+			t.Errorf("Verify(%s, %s) got %v, want %v", test.name, test.secret, err, test.want)
+		}
+	}
+	if !s.Exists("bot") {
+		t.Errorf("bot should exist")
+	}
+
+	//另一个进程添加的账户在Reload之后生效
+	other, _ := OpenFile(path)
+	other.Add("jerry", "秘密")
+	if err := s.Reload(); err != nil || s.Verify("jerry", "秘密") != nil {
+		t.Errorf("Reload got %v, jerry should exist", err)
+	}
+
+	for _, line := range []string{"tom zz\n", "tom md5 1000 00 00\n", "tom pbkdf2-sha256 0 00 00\n"} {
+		os.WriteFile(path, []byte(line), 0600)
+		if _, err := OpenFile(path); err == nil {
+			t.Errorf("invalid line %q, want error", line)
+		}
+	}
+	if err := s.Reload(); err == nil || !s.Exists("jerry") {
+		t.Errorf("invalid line, Reload should fail and keep accounts")
+	}
+}
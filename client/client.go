@@ -1,13 +1,19 @@
 package client
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/liuc2050/easychat/proto"
 	"github.com/liuc2050/easychat/util"
 )
 
@@ -15,62 +21,591 @@ type Client struct {
 	noCopy util.NoCopy
 
 	srvAddr string
-	conn    net.Conn
-	onRead  func(string)
+	onRead  func(*proto.Frame)
 	logger  *log.Logger
 	wg      *sync.WaitGroup
+
+	dial      Dialer        //建立连接，默认net.Dialer.DialContext
+	tlsConfig *tls.Config   //非nil时使用TLS连接
+	stop      chan struct{} //LeaveServer时关闭，结束自动重连
+
+	heartbeat   time.Duration //发送ping的间隔
+	idleTimeout time.Duration //超过该时间未收到任何帧则认为连接已断开，自动重连
+
+	mu         sync.Mutex
+	conn       net.Conn
+	nick       string
+	room       string                  //当前发言的房间，为空则是服务端的默认房间
+	joining    string                  //已请求加入、等待服务端确认的房间，确认后成为当前房间
+	rooms      map[string]bool         //已加入的房间，重连时重新加入
+	roster     map[string]proto.Member //服务器上的在线成员，由presence帧更新
+	lastID     uint64                  //最后收到的消息ID，重连时补发之后的消息
+	epoch      string                  //lastID所属的纪元，服务端重启后不同
+	session    string                  //服务端分配的会话，重连时接管昵称
+	password   string                  //服务端要求登录时发送的密码或令牌
+	kicked     bool                    //被管理员踢出或封禁，不再自动重连
+	closed     bool                    //服务端发送了close帧，不再自动重连
+	maxMessage int                     //服务端允许的消息文本最大字节数，0为未知
 }
 
-func New(srvAddr string, l *log.Logger, onRead func(string)) *Client {
-	return &Client{srvAddr: srvAddr, onRead: onRead, logger: l, wg: new(sync.WaitGroup)}
+const (
+	//自动重连的退避时间
+	minBackoff time.Duration = 500 * time.Millisecond
+	maxBackoff time.Duration = 30 * time.Second
+
+	defaultHeartbeat   time.Duration = 30 * time.Second
+	defaultIdleTimeout time.Duration = 90 * time.Second
+)
+
+//Dialer 建立到服务端的连接，network和address由util.ParseAddr解析srvAddr得到
+//srvAddr无法解析时network为空、address为srvAddr；ctx取消时应尽快返回
+type Dialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+//ErrRejected 服务端拒绝了握手（如昵称被占用），不再自动重连
+var ErrRejected = errors.New("rejected by server")
+
+//New 创建客户端，srvAddr的格式见util.ParseAddr，如"host:port"、"[::1]:port"、"unix:/path"
+func New(srvAddr, nick string, l *log.Logger, onRead func(*proto.Frame)) *Client {
+	return &Client{srvAddr: srvAddr, nick: nick, onRead: onRead, logger: l, wg: new(sync.WaitGroup),
+		rooms: make(map[string]bool), roster: make(map[string]proto.Member),
+		heartbeat: defaultHeartbeat, idleTimeout: defaultIdleTimeout}
 }
 
+//EnterServer 连接服务端并完成握手，之后断线时自动重连
 func (cli *Client) EnterServer() error {
+	return cli.EnterServerContext(context.Background())
+}
+
+//EnterServerContext 同EnterServer，ctx只用于首次连接和握手，取消或超时则返回ctx.Err()
+func (cli *Client) EnterServerContext(ctx context.Context) error {
 	if cli == nil {
 		return errors.New("EnterServer: cli is nil")
 	}
 
-	var err error
-	cli.conn, err = net.Dial("tcp", cli.srvAddr)
-	if err == nil && cli.onRead != nil {
-		cli.wg.Add(1)
-		go func() {
-			defer cli.wg.Done()
-			scanner := bufio.NewScanner(cli.conn)
-			for {
-				if scanner.Scan() {
-					cli.onRead(scanner.Text())
-				} else {
-					cli.logger.Printf("Read error:%s", scanner.Err())
-					break
+	conn, reader, err := cli.connect(ctx)
+	if err != nil {
+		return err
+	}
+	cli.mu.Lock()
+	cli.stop = make(chan struct{})
+	cli.conn = conn
+	cli.mu.Unlock()
+	cli.wg.Add(2)
+	go cli.read(reader)
+	go cli.ping()
+	return nil
+}
+
+//SetDialer 替换建立连接的方式，如memnet.Listener.DialContext，须在EnterServer之前调用
+//启用TLS时在dial返回的连接上握手
+func (cli *Client) SetDialer(dial Dialer) error {
+	if cli == nil {
+		return errors.New("SetDialer: cli is nil")
+	}
+	if dial == nil {
+		return errors.New("SetDialer: dial is nil")
+	}
+	cli.dial = dial
+	return nil
+}
+
+//SetHeartbeat 设置ping间隔和空闲超时，须在EnterServer之前调用
+func (cli *Client) SetHeartbeat(interval, timeout time.Duration) error {
+	if cli == nil {
+		return errors.New("SetHeartbeat: cli is nil")
+	}
+	if interval <= 0 || timeout <= interval {
+		return fmt.Errorf("SetHeartbeat: invalid interval[%v] or timeout[%v]", interval, timeout)
+	}
+	cli.heartbeat, cli.idleTimeout = interval, timeout
+	return nil
+}
+
+//goroutine 定时发送ping，重连期间发送失败忽略
+func (cli *Client) ping() {
+	defer cli.wg.Done()
+	ticker := time.NewTicker(cli.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cli.stop:
+			return
+		case <-ticker.C:
+			cli.writeFrame("ping", proto.New(proto.TypePing, "", "", ""))
+		}
+	}
+}
+
+//connect 建立连接并完成握手，ctx结束时中断
+func (cli *Client) connect(ctx context.Context) (net.Conn, *proto.Reader, error) {
+	dial := cli.dial
+	network, address, err := util.ParseAddr(cli.srvAddr)
+	if dial == nil {
+		if err != nil {
+			return nil, nil, err
+		}
+		dial = (&net.Dialer{}).DialContext
+	} else if err != nil {
+		network, address = "", cli.srvAddr
+	}
+	conn, err := dial(ctx, network, address)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(cli.idleTimeout))
+	//ctx结束时使阻塞的读写立即返回
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	fail := func(err error) (net.Conn, *proto.Reader, error) {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, nil, err
+	}
+	if cli.tlsConfig != nil {
+		tlsConn := tls.Client(conn, cli.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return fail(err)
+		}
+		conn = tlsConn
+	}
+	reader := proto.NewReader(conn)
+	if err := cli.handshake(conn, reader); err != nil {
+		return fail(err)
+	}
+	if !stop() {
+		//握手完成时ctx恰好结束
+		return fail(ctx.Err())
+	}
+	return conn, reader, nil
+}
+
+//handshake 发送hello声明昵称，服务端要求登录时回复auth，最后回复welcome或error
+//重连时带上会话、最后收到的消息ID和已加入的房间
+func (cli *Client) handshake(conn net.Conn, reader *proto.Reader) error {
+	cli.mu.Lock()
+	hello := proto.New(proto.TypeHello, cli.nick, "", cli.session)
+	hello.ID = cli.lastID
+	hello.Epoch = cli.epoch
+	for room := range cli.rooms {
+		hello.Rooms = append(hello.Rooms, room)
+	}
+	password := cli.password
+	cli.mu.Unlock()
+	if err := proto.Write(conn, hello); err != nil {
+		return err
+	}
+	f, err := readReply(reader)
+	if err == nil && f.Type == proto.TypeAuth {
+		if len(password) == 0 {
+			return fmt.Errorf("EnterServer: %w: login is required", ErrRejected)
+		}
+		if err := proto.Write(conn, proto.New(proto.TypeAuth, "", "", password)); err != nil {
+			return err
+		}
+		f, err = readReply(reader)
+	}
+	if err != nil {
+		return err
+	}
+	if f.Type == proto.TypeError {
+		return fmt.Errorf("EnterServer: %w: %s", ErrRejected, f.Text)
+	}
+	if f.Type != proto.TypeWelcome || f.From != hello.From {
+		return fmt.Errorf("EnterServer: invalid handshake reply[%s]", f.Type)
+	}
+	cli.mu.Lock()
+	cli.session = f.Text
+	cli.maxMessage = f.Count
+	if f.Epoch != cli.epoch {
+		//新的纪元ID重新开始
+		cli.epoch = f.Epoch
+		cli.lastID = 0
+	}
+	cli.mu.Unlock()
+	return nil
+}
+
+//readReply 读取握手中服务端的回复
+func readReply(reader *proto.Reader) (*proto.Frame, error) {
+	f, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("EnterServer: connection closed during handshake")
+	}
+	return f, err
+}
+
+//Login 设置服务端要求登录时使用的密码或令牌，须在EnterServer之前调用
+func (cli *Client) Login(password string) error {
+	if cli == nil {
+		return errors.New("Login: cli is nil")
+	}
+	if len(password) == 0 {
+		return errors.New("Login: password is empty")
+	}
+	cli.password = password
+	return nil
+}
+
+//goroutine 读取直到LeaveServer，连接意外断开时自动重连
+func (cli *Client) read(reader *proto.Reader) {
+	defer cli.wg.Done()
+	for reader != nil {
+		for {
+			cli.mu.Lock()
+			cli.conn.SetReadDeadline(time.Now().Add(cli.idleTimeout))
+			cli.mu.Unlock()
+			f, err := reader.Read()
+			if err == proto.ErrTooLarge {
+				cli.logger.Printf("Read error:%s", err)
+				continue
+			}
+			if err != nil {
+				cli.mu.Lock()
+				closed := cli.closed
+				cli.mu.Unlock()
+				select {
+				case <-cli.stop:
+					//LeaveServer关闭了连接
+					return
+				default:
+				}
+				if err != io.EOF && !closed {
+					cli.logger.Printf("Read error:%s", err)
 				}
+				//关闭断开的连接，重连期间ping不再写入
+				cli.mu.Lock()
+				cli.conn.Close()
+				cli.conn = nil
+				cli.mu.Unlock()
+				break
+			}
+			if f.Type == proto.TypePing {
+				cli.writeFrame("pong", proto.New(proto.TypePong, "", "", f.Text))
+			}
+			cli.track(f)
+			if cli.onRead != nil {
+				cli.onRead(f)
 			}
-		}()
+		}
+		reader = cli.reconnect()
 	}
-	return err
+}
+
+//reconnect 指数退避重连，LeaveServer或被服务端拒绝时返回nil
+func (cli *Client) reconnect() *proto.Reader {
+	//LeaveServer时中断正在进行的连接
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-cli.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for backoff := minBackoff; ; backoff *= 2 {
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		select {
+		case <-cli.stop:
+			return nil
+		default:
+		}
+		cli.mu.Lock()
+		kicked, closed := cli.kicked, cli.closed
+		cli.mu.Unlock()
+		if kicked {
+			cli.notice("kicked by operator, not reconnecting")
+			return nil
+		}
+		if closed {
+			//close帧已经显示了原因
+			return nil
+		}
+		cli.notice(fmt.Sprintf("connection lost, reconnecting in %v", backoff))
+		select {
+		case <-cli.stop:
+			return nil
+		case <-time.After(backoff):
+		}
+		conn, reader, err := cli.connect(ctx)
+		if err != nil {
+			cli.logger.Printf("reconnect error:%v", err)
+			if errors.Is(err, ErrRejected) {
+				cli.notice(err.Error())
+				return nil
+			}
+			continue
+		}
+		cli.mu.Lock()
+		select {
+		case <-cli.stop:
+			//重连期间已离开
+			cli.mu.Unlock()
+			conn.Close()
+			return nil
+		default:
+		}
+		cli.conn = conn
+		cli.mu.Unlock()
+		cli.notice("reconnected")
+		return reader
+	}
+}
+
+//notice 本地生成的通知
+func (cli *Client) notice(text string) {
+	if cli.onRead != nil {
+		cli.onRead(proto.New(proto.TypeNotice, "", "", text))
+	}
+}
+
+//track 根据服务端的确认更新昵称、房间和最后收到的消息ID
+func (cli *Client) track(f *proto.Frame) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	if f.ID > cli.lastID {
+		cli.lastID = f.ID
+	}
+	switch f.Type {
+	case proto.TypePresence:
+		switch f.Text {
+		case proto.PresenceRoster:
+			cli.roster = make(map[string]proto.Member)
+		case proto.PresenceOffline, proto.PresenceUpdate:
+			delete(cli.roster, f.From)
+		}
+		for _, m := range f.Members {
+			cli.roster[m.Nick] = m
+		}
+	case proto.TypeKick, proto.TypeBan:
+		if f.To == cli.nick {
+			cli.kicked = true
+		}
+	case proto.TypeClose:
+		cli.closed = true
+	case proto.TypeNick:
+		if f.From == cli.nick {
+			cli.nick = f.Text
+		}
+	case proto.TypeJoin:
+		if f.From == cli.nick {
+			cli.rooms[f.Room] = true
+			if f.Room == cli.joining {
+				cli.room, cli.joining = f.Room, ""
+			}
+		}
+	case proto.TypeError:
+		//加入被拒绝，仍在原来的房间发言
+		if len(f.Room) > 0 && f.Room == cli.joining {
+			cli.joining = ""
+		}
+	case proto.TypePart:
+		if f.From == cli.nick {
+			delete(cli.rooms, f.Room)
+			if f.Room == cli.room {
+				cli.room = ""
+			}
+		}
+	}
+}
+
+//Nickname 当前昵称
+func (cli *Client) Nickname() string {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	return cli.nick
+}
+
+//Members 在线成员，按昵称排序
+func (cli *Client) Members() []proto.Member {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	out := make([]proto.Member, 0, len(cli.roster))
+	for _, m := range cli.roster {
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Nick < out[j].Nick })
+	return out
+}
+
+//MaxMessage 服务端允许的消息文本最大字节数，未连接时为0
+func (cli *Client) MaxMessage() int {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	return cli.maxMessage
+}
+
+//checkSize 发送前检查消息长度，避免发送注定被拒绝的大消息
+func (cli *Client) checkSize(fn, msg string) error {
+	if max := cli.MaxMessage(); max > 0 && len(msg) > max {
+		return fmt.Errorf("%s: message is too large (%d > %d bytes)", fn, len(msg), max)
+	}
+	return nil
+}
+
+//Room 当前发言的房间，为空则是服务端的默认房间
+func (cli *Client) Room() string {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	return cli.room
 }
 
 func (cli *Client) LeaveServer() error {
 	if cli == nil {
 		return errors.New("LeaveServer: cli is nil")
 	}
-	if cli.conn == nil {
-		return errors.New("LeaveServer: cli.conn is nil")
+	cli.mu.Lock()
+	if cli.stop == nil {
+		cli.mu.Unlock()
+		return errors.New("LeaveServer: not entered")
 	}
-	if err := cli.conn.Close(); err != nil {
-		return err
+	select {
+	case <-cli.stop:
+		cli.mu.Unlock()
+		return errors.New("LeaveServer: already left")
+	default:
 	}
+	close(cli.stop)
+	var err error
+	if cli.conn != nil {
+		//重连期间没有连接
+		err = cli.conn.Close()
+	}
+	cli.mu.Unlock()
 	cli.wg.Wait()
-	return nil
+	cli.mu.Lock()
+	cli.conn = nil
+	cli.mu.Unlock()
+	return err
+}
+
+//writeFrame 写入当前连接，重连期间写入失败
+func (cli *Client) writeFrame(fn string, f *proto.Frame) error {
+	if cli == nil {
+		return errors.New(fn + ": cli is nil")
+	}
+	cli.mu.Lock()
+	conn := cli.conn
+	cli.mu.Unlock()
+	if conn == nil {
+		return errors.New(fn + ": cli.conn is nil")
+	}
+	return proto.Write(conn, f)
 }
 
+//Send 发送消息到当前房间，msg可以包含换行
 func (cli *Client) Send(msg string) error {
 	if cli == nil {
 		return errors.New("Send: cli is nil")
 	}
-	if cli.conn == nil {
-		return errors.New("Send: cli.conn is nil")
+	if err := cli.checkSize("Send", msg); err != nil {
+		return err
 	}
-	_, err := fmt.Fprintln(cli.conn, msg)
-	return err
+	return cli.writeFrame("Send", proto.New(proto.TypeMsg, "", cli.Room(), msg))
+}
+
+//SendDirect 私聊，只发给昵称为nick的用户，对方不在线会收到error帧
+func (cli *Client) SendDirect(nick, msg string) error {
+	if cli == nil {
+		return errors.New("SendDirect: cli is nil")
+	}
+	if len(nick) == 0 {
+		return errors.New("SendDirect: nick is empty")
+	}
+	if err := cli.checkSize("SendDirect", msg); err != nil {
+		return err
+	}
+	f := proto.New(proto.TypeDirect, "", "", msg)
+	f.To = nick
+	return cli.writeFrame("SendDirect", f)
+}
+
+//History 请求当前房间最近n条历史消息，n<=0时由服务端决定条数
+func (cli *Client) History(n int) error {
+	if cli == nil {
+		return errors.New("History: cli is nil")
+	}
+	f := proto.New(proto.TypeHistory, "", cli.Room(), "")
+	f.Count = n
+	return cli.writeFrame("History", f)
+}
+
+//Who 查询房间中的在线成员，room为空则查询整个服务器
+func (cli *Client) Who(room string) error {
+	if cli == nil {
+		return errors.New("Who: cli is nil")
+	}
+	return cli.writeFrame("Who", proto.New(proto.TypeWho, "", room, ""))
+}
+
+//Join 加入房间，服务端确认后发送的消息都发往该房间，已在房间中则立即切换
+func (cli *Client) Join(room string) error {
+	if err := cli.write("Join", proto.TypeJoin, room, ""); err != nil {
+		return err
+	}
+	cli.mu.Lock()
+	if cli.rooms[room] {
+		cli.room = room
+	} else {
+		cli.joining = room
+	}
+	cli.mu.Unlock()
+	return nil
+}
+
+//Part 退出房间，若为当前房间则回到默认房间
+func (cli *Client) Part(room string) error {
+	return cli.write("Part", proto.TypePart, room, "")
+}
+
+//Nick 修改昵称，服务端确认后生效，被拒绝会收到error帧
+func (cli *Client) Nick(nick string) error {
+	return cli.write("Nick", proto.TypeNick, "", nick)
+}
+
+func (cli *Client) write(fn string, t proto.Type, room, arg string) error {
+	if len(room+arg) == 0 || strings.ContainsAny(room+arg, " \t\n") {
+		return fmt.Errorf("%s: invalid argument[%s]", fn, room+arg)
+	}
+	return cli.writeFrame(fn, proto.New(t, "", room, arg))
+}
+
+//Kick 管理员踢出nick，reason可为空
+func (cli *Client) Kick(nick, reason string) error {
+	return cli.moderate("Kick", proto.TypeKick, nick, reason)
+}
+
+//Ban 管理员封禁昵称或IP，并踢出在线的连接
+func (cli *Client) Ban(target string) error {
+	return cli.moderate("Ban", proto.TypeBan, target, "")
+}
+
+func (cli *Client) Unban(target string) error {
+	return cli.moderate("Unban", proto.TypeUnban, target, "")
+}
+
+//Mute 管理员禁言昵称或IP，禁言期间不能发送房间消息和私聊，重连也不能解除
+func (cli *Client) Mute(target string) error {
+	return cli.moderate("Mute", proto.TypeMute, target, "")
+}
+
+func (cli *Client) Unmute(target string) error {
+	return cli.moderate("Unmute", proto.TypeUnmute, target, "")
+}
+
+//Op 将nick设为管理员
+func (cli *Client) Op(nick string) error {
+	return cli.moderate("Op", proto.TypeOp, nick, "")
+}
+
+func (cli *Client) moderate(fn string, t proto.Type, target, reason string) error {
+	if len(target) == 0 || strings.ContainsAny(target, " \t\n") {
+		return fmt.Errorf("%s: invalid argument[%s]", fn, target)
+	}
+	f := proto.New(t, "", "", reason)
+	f.To = target
+	return cli.writeFrame(fn, f)
 }
@@ -1,13 +1,49 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/liuc2050/easychat/memnet"
+	"github.com/liuc2050/easychat/proto"
+	"github.com/liuc2050/easychat/util"
 )
 
+var std = log.New(os.Stderr, "", log.LstdFlags)
+
+//accept 模拟服务端接受连接并完成昵称握手，reject非空则拒绝
+func accept(ln net.Listener, reject string) (net.Conn, *proto.Reader, error) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	r := proto.NewReader(conn)
+	f, err := r.Read()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	reply := proto.New(proto.TypeWelcome, f.From, "", "")
+	reply.Count = 64
+	if len(reject) > 0 {
+		reply = proto.New(proto.TypeError, "", "", reject)
+	}
+	proto.Write(conn, reply)
+	return conn, r, nil
+}
+
 func TestNew(t *testing.T) {
-	addr := "2395"
-	cli := New(addr)
+	addr := "chat"
+	cli := New(addr, "tom", std, nil)
 
 	if cli == nil {
 		t.Errorf("cli should not be nil")
@@ -16,6 +52,9 @@ func TestNew(t *testing.T) {
 	if cli.srvAddr != addr {
 		t.Errorf("got %s, want %s", cli.srvAddr, addr)
 	}
+	if cli.nick != "tom" {
+		t.Errorf("got %s, want %s", cli.nick, "tom")
+	}
 }
 
 func TestEnterServer(t *testing.T) {
@@ -23,7 +62,10 @@ func TestEnterServer(t *testing.T) {
 	if err := cli.EnterServer(); err == nil {
 		t.Errorf("when cli nil, it should return error")
 	}
-	cli = New("localhost:2048")
+	cli = New("chat", "tom", std, nil)
+	ln := memnet.Listen("chat")
+	cli.SetDialer(ln.DialContext)
+	ln.Close()
 	if err := cli.EnterServer(); err == nil {
 		t.Errorf("server not start, should return error")
 	}
@@ -31,16 +73,25 @@ func TestEnterServer(t *testing.T) {
 		t.Errorf("got conn not nil, want nil")
 	}
 
-	ln, err := net.Listen("tcp", ":2048")
-	if err != nil {
-		t.Fatalf("server start failed.%v", err)
-	}
+	ln = memnet.Listen("chat")
 	defer ln.Close()
+	cli.SetDialer(ln.DialContext)
 	go func() {
-		if _, err := ln.Accept(); err != nil {
-			t.Fatalf("accept err: %v", err)
+		if _, _, err := accept(ln, "nick[tom] is already in use"); err != nil {
+			t.Errorf("accept err: %v", err)
+			return
+		}
+		if _, _, err := accept(ln, ""); err != nil {
+			t.Errorf("accept err: %v", err)
+			return
 		}
 	}()
+	if err := cli.EnterServer(); err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("EnterServer got %v, want rejection", err)
+	}
+	if cli.conn != nil {
+		t.Errorf("rejected, got conn not nil")
+	}
 	if err := cli.EnterServer(); err != nil {
 		t.Fatalf("EneterServer got %v, want nil", err)
 	}
@@ -50,23 +101,130 @@ func TestEnterServer(t *testing.T) {
 	cli.LeaveServer()
 }
 
+func TestEnterUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen unix failed:%v", err)
+	}
+	defer ln.Close()
+	go accept(ln, "")
+	cli := New("unix:"+path, "tom", std, nil)
+	if err := cli.EnterServer(); err != nil {
+		t.Fatalf("EnterServer got %v, want nil", err)
+	}
+	cli.LeaveServer()
+	if err := New("unix:", "tom", std, nil).EnterServer(); err == nil {
+		t.Errorf("empty socket path should fail")
+	}
+}
+
+func TestSetDialer(t *testing.T) {
+	cli := New("chat", "tom", std, nil)
+	if err := cli.SetDialer(nil); err == nil {
+		t.Errorf("nil dialer should fail")
+	}
+	ln := memnet.Listen("chat")
+	defer ln.Close()
+	go accept(ln, "")
+	cli.SetDialer(ln.DialContext)
+	if err := cli.EnterServer(); err != nil {
+		t.Fatalf("EnterServer got %v, want nil", err)
+	}
+	if cli.MaxMessage() != 64 {
+		t.Errorf("MaxMessage got %d, want 64", cli.MaxMessage())
+	}
+	cli.LeaveServer()
+}
+
+func TestEnterServerContext(t *testing.T) {
+	ln := memnet.Listen("chat")
+	defer ln.Close()
+	//只接受连接，不回复握手
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	cli := New("chat", "tom", std, nil)
+	cli.SetDialer(ln.DialContext)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := cli.EnterServerContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("EnterServerContext got %v, want deadline exceeded", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := cli.EnterServerContext(ctx); err != context.Canceled {
+		t.Errorf("EnterServerContext got %v, want canceled", err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	var cli *Client
+	if err := cli.Login("pw"); err == nil {
+		t.Errorf("when cli nil, it should return error")
+	}
+	cli = New("chat", "tom", std, nil)
+	if err := cli.Login(""); err == nil {
+		t.Errorf("empty password, want error")
+	}
+	ln := memnet.Listen("chat")
+	defer ln.Close()
+	cli.SetDialer(ln.DialContext)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := proto.NewReader(conn)
+			hello, _ := r.Read()
+			proto.Write(conn, proto.New(proto.TypeAuth, hello.From, "", ""))
+			reply := proto.New(proto.TypeError, "", "", "invalid nick or password")
+			if f, err := r.Read(); err == nil && f.Type == proto.TypeAuth && f.Text == "pw" {
+				reply = proto.New(proto.TypeWelcome, hello.From, "", "tok")
+			}
+			proto.Write(conn, reply)
+			defer conn.Close()
+		}
+	}()
+	if err := cli.EnterServer(); !errors.Is(err, ErrRejected) || !strings.Contains(err.Error(), "login is required") {
+		t.Errorf("no password got %v, want login required", err)
+	}
+	cli.Login("bad")
+	if err := cli.EnterServer(); !errors.Is(err, ErrRejected) {
+		t.Errorf("wrong password got %v, want rejected", err)
+	}
+	cli.Login("pw")
+	if err := cli.EnterServer(); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	cli.LeaveServer()
+}
+
 func TestLeaveServer(t *testing.T) {
 	var cli *Client
 	if err := cli.LeaveServer(); err == nil {
 		t.Errorf("when cli nil, it should return error")
 	}
 
-	cli = New("localhost:2048")
+	cli = New("chat", "tom", std, nil)
 	if err := cli.LeaveServer(); err == nil {
-		t.Errorf("when cli.conn nil, it should return error")
+		t.Errorf("before EnterServer, it should return error")
 	}
 
-	ln, _ := net.Listen("tcp", ":2048")
+	ln := memnet.Listen("chat")
+	defer ln.Close()
+	cli.SetDialer(ln.DialContext)
 	stopCh := make(chan struct{})
 	go func() {
-		conn, err := ln.Accept()
+		conn, _, err := accept(ln, "")
 		if err != nil {
-			t.Fatalf("accept err: %v", err)
+			t.Errorf("accept err: %v", err)
+			return
 		}
 		select {
 		case <-stopCh:
@@ -77,6 +235,9 @@ func TestLeaveServer(t *testing.T) {
 	if err := cli.LeaveServer(); err != nil {
 		t.Errorf("got [%v], want nil", err)
 	}
+	if err := cli.LeaveServer(); err == nil {
+		t.Errorf("second LeaveServer should fail")
+	}
 	close(stopCh)
 }
 
@@ -85,24 +246,24 @@ func TestSend(t *testing.T) {
 	if err := cli.Send("dkkd"); err == nil {
 		t.Errorf("when cli nil, should return error")
 	}
-	cli = New("localhost:3047")
+	cli = New("chat", "tom", std, nil)
 	if err := cli.Send("跨学科"); err == nil {
 		t.Errorf("got nil , want error")
 	}
 
-	ln, _ := net.Listen("tcp", ":3047")
+	ln := memnet.Listen("chat")
+	defer ln.Close()
+	cli.SetDialer(ln.DialContext)
 	stopCh := make(chan struct{})
 	msg := "可哦哦巍峨"
 	go func() {
-		conn, err := ln.Accept()
+		conn, r, err := accept(ln, "")
 		if err != nil {
-			t.Fatalf("accept err: %v", err)
+			t.Errorf("accept err: %v", err)
+			return
 		}
-		var buf [2048]byte
-		n, _ := conn.Read(buf[:])
-		s := string(buf[:n])
-		if s != msg+"\n" {
-			t.Errorf("got %s", s)
+		if f, err := r.Read(); err != nil || f.Type != proto.TypeMsg || f.Text != msg {
+			t.Errorf("got %v %v", f, err)
 		}
 		select {
 		case <-stopCh:
@@ -110,6 +271,12 @@ func TestSend(t *testing.T) {
 		}
 	}()
 	cli.EnterServer()
+	if cli.MaxMessage() != 64 {
+		t.Errorf("got max message %d, want 64", cli.MaxMessage())
+	}
+	if err := cli.Send(strings.Repeat("长", 22)); err == nil {
+		t.Errorf("message too large, want error")
+	}
 	if err := cli.Send(msg); err != nil {
 		t.Errorf("got error[%v], want nil", err)
 	}
@@ -118,3 +285,389 @@ func TestSend(t *testing.T) {
 	}
 	close(stopCh)
 }
+
+func TestLineCmd(t *testing.T) {
+	var cli *Client
+	if err := cli.Join("go"); err == nil {
+		t.Errorf("when cli nil, should return error")
+	}
+	frames := make(chan *proto.Frame)
+	cli = New("chat", "tom", std, func(f *proto.Frame) {
+		frames <- f
+	})
+	if err := cli.Part("go"); err == nil {
+		t.Errorf("got nil , want error")
+	}
+
+	ln := memnet.Listen("chat")
+	defer ln.Close()
+	cli.SetDialer(ln.DialContext)
+	//net.Pipe没有缓冲，服务端读到的帧先缓存，客户端的写入才不会阻塞
+	got := make(chan *proto.Frame, 16)
+	go func() {
+		defer close(got)
+		conn, r, err := accept(ln, "")
+		if err != nil {
+			t.Errorf("accept err: %v", err)
+			return
+		}
+		defer conn.Close()
+		for {
+			f, err := r.Read()
+			if err != nil {
+				return
+			}
+			got <- f
+			//模拟服务端确认
+			switch f.Type {
+			case proto.TypeJoin:
+				if strings.HasPrefix(f.Room, "#") {
+					proto.Write(conn, proto.New(proto.TypeError, "", f.Room, "room["+f.Room+"] contains invalid characters"))
+				} else {
+					proto.Write(conn, proto.New(proto.TypeJoin, "tom", f.Room, ""))
+				}
+			case proto.TypeNick:
+				proto.Write(conn, proto.New(proto.TypeNick, "tom", "", f.Text))
+			case proto.TypePart:
+				proto.Write(conn, proto.New(proto.TypePart, "jerry", f.Room, ""))
+			}
+		}
+	}()
+	cli.EnterServer()
+	if err := cli.Join("bad room"); err == nil {
+		t.Errorf("invalid room name, want error")
+	}
+	if err := cli.SendDirect("", "hi"); err == nil {
+		t.Errorf("empty nick, want error")
+	}
+	//服务端确认后才切换房间
+	cli.Join("#general")
+	<-frames
+	if cli.Room() != "" {
+		t.Errorf("rejected join got room %s, want default room", cli.Room())
+	}
+	cli.Join("go")
+	<-frames
+	if cli.Room() != "go" {
+		t.Errorf("got room %s, want go", cli.Room())
+	}
+	cli.Send("/join 多行\n文本")
+	cli.SendDirect("spike", "悄悄话")
+	cli.History(5)
+	if err := cli.Ban(""); err == nil {
+		t.Errorf("empty target, want error")
+	}
+	cli.Who("go")
+	cli.Kick("spike", "spam")
+	cli.Ban("10.0.0.1")
+	cli.Nick("jerry")
+	for _, want := range []*proto.Frame{
+		{Type: proto.TypeJoin, Room: "#general"},
+		{Type: proto.TypeJoin, Room: "go"},
+		{Type: proto.TypeMsg, Room: "go", Text: "/join 多行\n文本"},
+		{Type: proto.TypeDirect, To: "spike", Text: "悄悄话"},
+		{Type: proto.TypeHistory, Room: "go", Count: 5},
+		{Type: proto.TypeWho, Room: "go"},
+		{Type: proto.TypeKick, To: "spike", Text: "spam"},
+		{Type: proto.TypeBan, To: "10.0.0.1"},
+		{Type: proto.TypeNick, Text: "jerry"},
+	} {
+		if f := <-got; f.Type != want.Type || f.Room != want.Room || f.Text != want.Text || f.To != want.To || f.Count != want.Count {
+			t.Errorf("got %#v, want %#v", f, want)
+		}
+	}
+	<-frames
+	if cli.Nickname() != "jerry" {
+		t.Errorf("got nick %s, want jerry", cli.Nickname())
+	}
+	cli.Part("go")
+	<-got
+	<-frames
+	if cli.Room() != "" {
+		t.Errorf("got room %s, want default room", cli.Room())
+	}
+	if err := cli.LeaveServer(); err != nil {
+		t.Errorf("got error[%v], want nil", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	frames := make(chan *proto.Frame, 16)
+	cli := New("chat", "tom", std, func(f *proto.Frame) {
+		frames <- f
+	})
+	ln := memnet.Listen("chat")
+	defer ln.Close()
+	cli.SetDialer(ln.DialContext)
+	hellos := make(chan *proto.Frame, 2)
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := proto.NewReader(conn)
+			f, err := r.Read()
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			hellos <- f
+			//第二个连接时服务端已重启，ID重新开始
+			welcome := proto.New(proto.TypeWelcome, f.From, "", "tok")
+			welcome.Epoch = "e0"
+			if i > 0 {
+				welcome.Epoch = "e1"
+			}
+			proto.Write(conn, welcome)
+			if i > 0 {
+				defer conn.Close()
+				continue
+			}
+			//第一个连接收到消息后断开
+			join := proto.New(proto.TypeJoin, "tom", "go", "")
+			msg := proto.New(proto.TypeMsg, "jerry", "go", "hi")
+			msg.ID = 7
+			proto.Write(conn, join)
+			proto.Write(conn, msg)
+			conn.Close()
+		}
+	}()
+	if err := cli.EnterServer(); err != nil {
+		t.Fatalf("EnterServer error:%v", err)
+	}
+	if f := <-hellos; len(f.Text) != 0 || f.ID != 0 || len(f.Rooms) != 0 {
+		t.Errorf("first hello got %#v", f)
+	}
+	f := <-hellos
+	if f.Text != "tok" || f.ID != 7 || f.Epoch != "e0" || len(f.Rooms) != 1 || f.Rooms[0] != "go" {
+		t.Errorf("reconnect hello got %#v, want session, last id, epoch and rooms", f)
+	}
+	for _, want := range []string{"go", "hi", "connection lost, reconnecting in 500ms", "reconnected"} {
+		select {
+		case f := <-frames:
+			if got := f.Text + f.Room; !strings.Contains(got, want) {
+				t.Errorf("got %v, want %s", f, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("recv %s timeout", want)
+		}
+	}
+	cli.mu.Lock()
+	if cli.lastID != 0 || cli.epoch != "e1" {
+		t.Errorf("new epoch got last id %d epoch %s, want 0 e1", cli.lastID, cli.epoch)
+	}
+	cli.mu.Unlock()
+	if err := cli.LeaveServer(); err != nil {
+		t.Errorf("got error[%v], want nil", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	frames := make(chan *proto.Frame, 16)
+	cli := New("chat", "tom", std, func(f *proto.Frame) {
+		frames <- f
+	})
+	ln := memnet.Listen("chat")
+	defer ln.Close()
+	accepted := make(chan bool, 2)
+	go func() {
+		for {
+			conn, _, err := accept(ln, "")
+			if err != nil {
+				return
+			}
+			accepted <- true
+			proto.Write(conn, proto.New(proto.TypeClose, "", "", "server shutting down"))
+			conn.Close()
+		}
+	}()
+	cli.SetDialer(ln.DialContext)
+	if err := cli.EnterServer(); err != nil {
+		t.Fatalf("EnterServer error:%v", err)
+	}
+	<-accepted
+	select {
+	case f := <-frames:
+		if f.Type != proto.TypeClose || f.Text != "server shutting down" {
+			t.Errorf("got %v, want close", f)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("recv close timeout")
+	}
+	select {
+	case <-accepted:
+		t.Errorf("should not reconnect after close")
+	case f := <-frames:
+		t.Errorf("got %v after close", f)
+	case <-time.After(time.Second):
+	}
+	cli.LeaveServer()
+}
+
+func TestMembers(t *testing.T) {
+	cli := New("chat", "tom", std, nil)
+	presence := func(from, text string, nicks ...string) *proto.Frame {
+		f := proto.New(proto.TypePresence, from, "", text)
+		for _, nick := range nicks {
+			f.Members = append(f.Members, proto.Member{Nick: nick})
+		}
+		return f
+	}
+	tests := []struct {
+		f    *proto.Frame
+		want string
+	}{
+		{presence("tom", proto.PresenceRoster, "tom", "jerry"), "jerry,tom"},
+		{presence("spike", proto.PresenceOnline, "spike"), "jerry,spike,tom"},
+		{presence("jerry", proto.PresenceUpdate, "cat"), "cat,spike,tom"},
+		{presence("spike", proto.PresenceOffline), "cat,tom"},
+		{presence("tom", proto.PresenceRoster, "tom"), "tom"},
+	}
+	for i, test := range tests {
+		cli.track(test.f)
+		var nicks []string
+		for _, m := range cli.Members() {
+			nicks = append(nicks, m.Nick)
+		}
+		if got := strings.Join(nicks, ","); got != test.want {
+			t.Errorf("test%d got %s, want %s", i, got, test.want)
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	frames := make(chan *proto.Frame, 16)
+	cli := New("chat", "tom", std, func(f *proto.Frame) {
+		frames <- f
+	})
+	if err := cli.SetHeartbeat(time.Second, 0); err == nil {
+		t.Errorf("invalid timeout, want error")
+	}
+	cli.SetHeartbeat(50*time.Millisecond, 200*time.Millisecond)
+	ln := memnet.Listen("chat")
+	defer ln.Close()
+	cli.SetDialer(ln.DialContext)
+	pings := make(chan *proto.Frame, 16)
+	gone := make(chan struct{}) //客户端关闭了连接
+	go func() {
+		//只读取不回复，客户端应超时
+		conn, r, err := accept(ln, "")
+		if err != nil {
+			return
+		}
+		defer close(gone)
+		defer conn.Close()
+		proto.Write(conn, proto.New(proto.TypePing, "", "", "1"))
+		for {
+			f, err := r.Read()
+			if err != nil {
+				return
+			}
+			pings <- f
+		}
+	}()
+	if err := cli.EnterServer(); err != nil {
+		t.Fatalf("EnterServer error:%v", err)
+	}
+	defer cli.LeaveServer()
+	if f := <-pings; f.Type != proto.TypePong || f.Text != "1" {
+		t.Errorf("got %v, want pong", f)
+	}
+	if f := <-pings; f.Type != proto.TypePing {
+		t.Errorf("got %v, want ping", f)
+	}
+	for {
+		select {
+		case f := <-frames:
+			if f.Type == proto.TypeNotice && strings.Contains(f.Text, "connection lost") {
+				//重连之前关闭超时的连接
+				select {
+				case <-gone:
+				case <-time.After(time.Second):
+					t.Errorf("timed out connection should be closed")
+				}
+				return
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("client should time out")
+		}
+	}
+}
+
+//tlsListen 在临时目录生成自签名证书并监听TLS
+func tlsListen(t *testing.T, addr string) (net.Listener, string, string) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	cert, err := util.LoadOrCreateCert(certFile, filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatalf("LoadOrCreateCert error:%v", err)
+	}
+	ln, err := tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("listen error:%v", err)
+	}
+	return ln, util.Fingerprint(cert.Certificate[0]), certFile
+}
+
+func TestUseTLS(t *testing.T) {
+	var cli *Client
+	if err := cli.UseTLS(TLSConfig{}); err == nil {
+		t.Errorf("when cli nil, should return error")
+	}
+	cli = New("localhost:0", "tom", std, nil)
+	if err := cli.UseTLS(TLSConfig{}); err == nil {
+		t.Errorf("empty config, want error")
+	}
+
+	ln, fp, certFile := tlsListen(t, ":0")
+	defer ln.Close()
+	addr := util.DialAddr(ln.Addr())
+	go func() {
+		for {
+			conn, _, err := accept(ln, "")
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			conn.Close()
+		}
+	}()
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	tests := []struct {
+		conf TLSConfig
+		ok   bool
+	}{
+		{TLSConfig{CAFile: certFile}, true},
+		{TLSConfig{Fingerprint: fp}, true},
+		{TLSConfig{Fingerprint: strings.Repeat("0", len(fp))}, false},
+		{TLSConfig{KnownHosts: knownHosts}, true}, //首次信任
+		{TLSConfig{KnownHosts: knownHosts}, true},
+	}
+	for i, test := range tests {
+		cli := New(addr, "tom", std, nil)
+		if err := cli.UseTLS(test.conf); err != nil {
+			t.Fatalf("test%d UseTLS error:%v", i, err)
+		}
+		err := cli.EnterServer()
+		if (err == nil) != test.ok {
+			t.Errorf("test%d EnterServer got %v, want ok %v", i, err, test.ok)
+		}
+		if err == nil {
+			cli.LeaveServer()
+		}
+	}
+	if data, _ := os.ReadFile(knownHosts); string(data) != addr+" "+fp+"\n" {
+		t.Errorf("known_hosts got %q", data)
+	}
+
+	//证书变化后拒绝
+	os.WriteFile(knownHosts, []byte(addr+" "+strings.Repeat("0", len(fp))+"\n"), 0600)
+	cli = New(addr, "tom", std, nil)
+	cli.UseTLS(TLSConfig{KnownHosts: knownHosts})
+	if err := cli.EnterServer(); err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Errorf("certificate changed, got %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/liuc2050/easychat/util"
+)
+
+//TLSConfig 客户端TLS设置，按CAFile、Fingerprint、KnownHosts的优先级校验服务端
+type TLSConfig struct {
+	CAFile      string //CA证书文件，按CA校验服务端证书
+	Fingerprint string //固定的服务端证书指纹
+	KnownHosts  string //首次信任（trust-on-first-use）的指纹存储文件
+}
+
+//UseTLS 启用TLS，须在EnterServer之前调用
+func (cli *Client) UseTLS(conf TLSConfig) error {
+	if cli == nil {
+		return errors.New("UseTLS: cli is nil")
+	}
+	host := cli.srvAddr
+	if network, address, err := util.ParseAddr(cli.srvAddr); err == nil {
+		host = "localhost" //Unix域套接字按本机校验
+		if network != "unix" {
+			host, _, _ = net.SplitHostPort(address)
+		}
+	}
+	c := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	switch {
+	case len(conf.CAFile) > 0:
+		pem, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("UseTLS: no certificate found in %s", conf.CAFile)
+		}
+	case len(conf.Fingerprint) > 0:
+		c.InsecureSkipVerify = true //由指纹校验代替
+		c.VerifyPeerCertificate = pinned(strings.ToLower(conf.Fingerprint))
+	case len(conf.KnownHosts) > 0:
+		c.InsecureSkipVerify = true //由指纹校验代替
+		c.VerifyPeerCertificate = (&knownHosts{file: conf.KnownHosts}).verify(cli.srvAddr)
+	default:
+		return errors.New("UseTLS: one of CAFile, Fingerprint and KnownHosts is required")
+	}
+	cli.tlsConfig = c
+	return nil
+}
+
+type verifyFunc func(rawCerts [][]byte, chains [][]*x509.Certificate) error
+
+func pinned(fingerprint string) verifyFunc {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no server certificate")
+		}
+		if got := util.Fingerprint(rawCerts[0]); got != fingerprint {
+			return fmt.Errorf("server certificate fingerprint %s does not match %s", got, fingerprint)
+		}
+		return nil
+	}
+}
+
+//knownHosts 每行"地址 指纹"，首次连接时记录，之后须一致
+type knownHosts struct {
+	file string
+	mu   sync.Mutex
+}
+
+func (k *knownHosts) verify(addr string) verifyFunc {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no server certificate")
+		}
+		got := util.Fingerprint(rawCerts[0])
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		want, err := k.lookup(addr)
+		if err != nil {
+			return err
+		}
+		if len(want) == 0 {
+			return k.add(addr, got)
+		}
+		if got != want {
+			return fmt.Errorf("server certificate of %s has changed: got %s, want %s (see %s)",
+				addr, got, want, k.file)
+		}
+		return nil
+	}
+}
+
+func (k *knownHosts) lookup(addr string) (string, error) {
+	f, err := os.Open(k.file)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == addr {
+			return fields[1], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+func (k *knownHosts) add(addr, fingerprint string) error {
+	if err := os.MkdirAll(filepath.Dir(k.file), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(k.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s %s\n", addr, fingerprint)
+	return err
+}
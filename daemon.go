@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/liuc2050/easychat/server"
+)
+
+//runDaemon 只运行服务器，不连接本地客户端：easychat [flags] serve [-tls] [ip][:]port|unix:path
+//收到SIGINT或SIGTERM时优雅关闭（再次收到时立即退出），收到SIGHUP时重新打开日志文件并重新读取账户和封禁文件，其他设置须重启才生效
+func runDaemon(args []string) error {
+	args, useTLS := tlsArg(args)
+	if len(args) != 2 {
+		return errors.New("usage: easychat [flags] serve [-tls] [ip][:]port|unix:path")
+	}
+	srv, err := buildServer(args[1])
+	if err != nil {
+		return err
+	}
+	if useTLS {
+		fp, err := srv.UseTLS(*certFile, *keyFile)
+		if err != nil {
+			return err
+		}
+		logger.Printf("server certificate fingerprint: %s", fp)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	//先监听再报告，地址为实际监听的地址（如端口为0时）
+	if err := srv.Start(); err != nil {
+		return err
+	}
+	logger.Printf("server[%s] is serving.", srv.Addr())
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Wait(ctx)
+	}()
+	done := ctx.Done()
+	for {
+		select {
+		case <-done:
+			//恢复信号的默认处理，优雅关闭期间再次收到信号时立即退出
+			stop()
+			done = nil
+			logger.Printf("server[%s] is shutting down, signal again to quit immediately.", srv.Addr())
+		case err := <-served:
+			if err == nil {
+				logger.Printf("server[%s] is shut down.", srv.Addr())
+			}
+			return err
+		case <-hup:
+			reload(srv)
+		}
+	}
+}
+
+//reload 重新打开日志文件（配合logrotate等），并重新读取账户和封禁文件
+func reload(srv *server.Server) {
+	if len(*fileName) > 0 {
+		file, err := openLog(*fileName)
+		if err != nil {
+			logger.Printf("reopen log error:%v", err)
+		} else {
+			//SetOutput之后旧文件不再被写入
+			logger.SetOutput(file)
+			logFile.Close()
+			logFile = file
+		}
+	}
+	if err := srv.Reload(); err != nil {
+		logger.Printf("reload error:%v", err)
+		return
+	}
+	logger.Printf("reloaded.")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liuc2050/easychat/proto"
+)
+
+//printer headless模式下逐行输出通知和收到的帧
+type printer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	asJSON bool //每行一个JSON编码的Frame，否则为转义了换行的Frame.String()
+}
+
+//plainEscaper plain格式下一帧只占一行，多行的消息和命令输出中的换行转义为\n
+var plainEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+
+func newPrinter(w io.Writer, format string) (*printer, error) {
+	switch format {
+	case "plain":
+		return &printer{w: w}, nil
+	case "json":
+		return &printer{w: w, asJSON: true}, nil
+	default:
+		return nil, fmt.Errorf("newPrinter: invalid format[%s], should be plain or json", format)
+	}
+}
+
+//notice 本地的通知（命令输出、错误等）按notice帧输出
+func (p *printer) notice(s string) {
+	p.frame(proto.New(proto.TypeNotice, "", "", strings.TrimRight(s, "\n")))
+}
+
+func (p *printer) frame(f *proto.Frame) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.asJSON {
+		fmt.Fprintln(p.w, plainEscaper.Replace(f.String()))
+		return
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	p.w.Write(append(b, '\n'))
+}
+
+//runHeadless 不使用终端界面，从r逐行读取：以:开头的是命令，其余是消息，空行被忽略
+//r结束后再等待-linger（期间继续输出收到的帧），然后离开服务器并返回
+func runHeadless(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), proto.MaxFrameSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, ":") {
+			args := strings.Fields(line[1:])
+			if len(args) == 0 {
+				continue
+			}
+			if err := executeCmd(args); err != nil {
+				if _, ok := err.(*argsErr); !ok {
+					return err
+				}
+				notify(err.Error())
+			}
+		} else if len(line) > 0 {
+			if err := sendMsg(line); err != nil {
+				notify(err.Error())
+			}
+		}
+
+		select {
+		case <-shouldExit:
+			return nil
+		default:
+			//do nothing
+		}
+	}
+	if cli != nil && *linger > 0 {
+		//管道输入很快结束，等待服务端的回复
+		select {
+		case <-time.After(*linger):
+		case <-shouldExit:
+		}
+	}
+	if err := leaveServer(nil); err != nil {
+		return err
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,178 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/liuc2050/easychat/proto"
+)
+
+//File 磁盘上只追加的日志，每行一条JSON编码的消息
+//打开时建立每条消息在文件中位置的索引，查询只读取需要的行
+type File struct {
+	mu     sync.Mutex
+	f      *os.File
+	lastID uint64
+	size   int64    //文件的长度，新消息写在这里
+	index  []record //按ID递增
+}
+
+//record 一条消息在文件中的位置
+type record struct {
+	id  uint64
+	off int64
+	len int
+}
+
+//OpenFile 打开或创建日志文件，ID接着文件中最后一条继续
+func OpenFile(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &File{f: f}
+	err = s.scan(func(fr *proto.Frame, off int64, n int) {
+		s.index = append(s.index, record{fr.ID, off, n})
+		s.lastID = fr.ID
+	})
+	if err == nil {
+		err = s.terminate()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+//terminate 上次写入中断时补上换行，避免与新消息连成一行，并更新文件的长度
+func (s *File) terminate() error {
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = info.Size()
+	if s.size == 0 {
+		return nil
+	}
+	var last [1]byte
+	if _, err := s.f.ReadAt(last[:], s.size-1); err != nil {
+		return err
+	}
+	if last[0] != '\n' {
+		if _, err = s.f.Write([]byte{'\n'}); err == nil {
+			s.size++
+		}
+	}
+	return err
+}
+
+func (s *File) Append(f *proto.Frame) error {
+	if f == nil {
+		return errors.New("File.Append: f is nil")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f.ID = s.lastID + 1
+	line, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := s.f.Write(line); err != nil {
+		//可能写入了一部分
+		s.terminate()
+		return err
+	}
+	s.index = append(s.index, record{f.ID, s.size, len(line)})
+	s.size += int64(len(line))
+	s.lastID = f.ID
+	return nil
+}
+
+func (s *File) Last(n int, match func(*proto.Frame) bool) ([]*proto.Frame, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	//从最新的消息往前读，够n条即停止
+	var out []*proto.Frame
+	for i := len(s.index) - 1; i >= 0 && len(out) < n; i-- {
+		f, err := s.read(s.index[i])
+		if err != nil {
+			return nil, err
+		}
+		if match == nil || match(f) {
+			out = append(out, f)
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
+
+func (s *File) Since(id uint64, match func(*proto.Frame) bool) ([]*proto.Frame, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*proto.Frame
+	start := sort.Search(len(s.index), func(i int) bool { return s.index[i].id > id })
+	for _, r := range s.index[start:] {
+		f, err := s.read(r)
+		if err != nil {
+			return nil, err
+		}
+		if match == nil || match(f) {
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
+
+func (s *File) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+//scan 从头读取所有消息及其位置和长度；损坏的行（如写入中断）被跳过
+func (s *File) scan(fn func(f *proto.Frame, off int64, n int)) error {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(s.f)
+	var off int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f := new(proto.Frame)
+		if json.Unmarshal(line, f) == nil {
+			fn(f, off, len(line))
+		}
+		off += int64(len(line))
+	}
+}
+
+//read 读取索引指向的一条消息
+func (s *File) read(r record) (*proto.Frame, error) {
+	line := make([]byte, r.len)
+	if _, err := s.f.ReadAt(line, r.off); err != nil {
+		return nil, err
+	}
+	f := new(proto.Frame)
+	if err := json.Unmarshal(line, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,88 @@
+//Package history 保存聊天消息，供进入服务器或房间时回放
+package history
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/liuc2050/easychat/proto"
+)
+
+//Store 消息存储，Append时分配递增的ID
+type Store interface {
+	Append(f *proto.Frame) error
+	//Last 最近n条满足match的消息，按ID升序
+	Last(n int, match func(*proto.Frame) bool) ([]*proto.Frame, error)
+	//Since ID大于id且满足match的消息，按ID升序
+	Since(id uint64, match func(*proto.Frame) bool) ([]*proto.Frame, error)
+	Close() error
+}
+
+//Memory 内存中的环形缓冲，超过容量后覆盖最旧的消息
+type Memory struct {
+	mu     sync.Mutex
+	buf    []*proto.Frame
+	start  int //最旧消息的下标
+	lastID uint64
+}
+
+func NewMemory(capacity int) *Memory {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &Memory{buf: make([]*proto.Frame, 0, capacity)}
+}
+
+func (m *Memory) Append(f *proto.Frame) error {
+	if f == nil {
+		return errors.New("Memory.Append: f is nil")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastID++
+	f.ID = m.lastID
+	if len(m.buf) < cap(m.buf) {
+		m.buf = append(m.buf, f)
+		return nil
+	}
+	m.buf[m.start] = f
+	m.start = (m.start + 1) % len(m.buf)
+	return nil
+}
+
+func (m *Memory) Last(n int, match func(*proto.Frame) bool) ([]*proto.Frame, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []*proto.Frame
+	for i := len(m.buf) - 1; i >= 0 && len(out) < n; i-- {
+		f := m.buf[(m.start+i)%len(m.buf)]
+		if match == nil || match(f) {
+			out = append(out, f)
+		}
+	}
+	reverse(out)
+	return out, nil
+}
+
+func (m *Memory) Since(id uint64, match func(*proto.Frame) bool) ([]*proto.Frame, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []*proto.Frame
+	for i := 0; i < len(m.buf); i++ {
+		f := m.buf[(m.start+i)%len(m.buf)]
+		if f.ID > id && (match == nil || match(f)) {
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func reverse(fs []*proto.Frame) {
+	for i, j := 0, len(fs)-1; i < j; i, j = i+1, j-1 {
+		fs[i], fs[j] = fs[j], fs[i]
+	}
+}
@@ -0,0 +1,121 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/liuc2050/easychat/proto"
+)
+
+func texts(fs []*proto.Frame) []string {
+	out := make([]string, 0, len(fs))
+	for _, f := range fs {
+		out = append(out, f.Text)
+	}
+	return out
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func inRoom(room string) func(*proto.Frame) bool {
+	return func(f *proto.Frame) bool {
+		return f.Room == room
+	}
+}
+
+//testStore 依次写入a1 b1 a2 b2 a3 b3，a在房间a，b在房间b
+func testStore(t *testing.T, s Store) {
+	if err := s.Append(nil); err == nil {
+		t.Errorf("when f nil, should return error")
+	}
+	for i := 1; i <= 3; i++ {
+		for _, room := range []string{"a", "b"} {
+			f := proto.New(proto.TypeMsg, "tom", room, room+string(rune('0'+i)))
+			if err := s.Append(f); err != nil {
+				t.Fatalf("Append error:%v", err)
+			}
+		}
+	}
+	tests := []struct {
+		n    int
+		room string
+		want []string
+	}{
+		{2, "a", []string{"a2", "a3"}},
+		{10, "b", []string{"b1", "b2", "b3"}},
+		{0, "a", []string{}},
+		{1, "c", []string{}},
+	}
+	for _, test := range tests {
+		fs, err := s.Last(test.n, inRoom(test.room))
+		if err != nil || !equal(texts(fs), test.want) {
+			t.Errorf("Last(%d, %s) got %v %v, want %v", test.n, test.room, texts(fs), err, test.want)
+		}
+	}
+	fs, err := s.Last(3, nil)
+	if err != nil || !equal(texts(fs), []string{"b2", "a3", "b3"}) {
+		t.Errorf("Last(3, nil) got %v %v", texts(fs), err)
+	}
+	fs, err = s.Since(fs[0].ID, inRoom("a"))
+	if err != nil || !equal(texts(fs), []string{"a3"}) {
+		t.Errorf("Since got %v %v, want [a3]", texts(fs), err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory(6)
+	testStore(t, m)
+	//容量为6，最旧的a1被覆盖
+	m.Append(proto.New(proto.TypeMsg, "tom", "a", "a4"))
+	fs, _ := m.Since(0, nil)
+	if !equal(texts(fs), []string{"b1", "a2", "b2", "a3", "b3", "a4"}) {
+		t.Errorf("got %v", texts(fs))
+	}
+	if fs[5].ID != 7 {
+		t.Errorf("got id %d, want 7", fs[5].ID)
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.log")
+	s, err := OpenFile(path)
+	if err != nil {
+		t.Fatalf("OpenFile error:%v", err)
+	}
+	testStore(t, s)
+	s.Close()
+
+	//模拟写入中断留下的半行
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"v":1,"id":7,"te`)
+	f.Close()
+
+	s, err = OpenFile(path)
+	if err != nil {
+		t.Fatalf("reopen error:%v", err)
+	}
+	defer s.Close()
+	fr := proto.New(proto.TypeMsg, "tom", "a", "a4")
+	if err := s.Append(fr); err != nil || fr.ID != 7 {
+		t.Fatalf("Append got id %d %v, want 7", fr.ID, err)
+	}
+	fs, err := s.Since(0, inRoom("a"))
+	if err != nil || !equal(texts(fs), []string{"a1", "a2", "a3", "a4"}) {
+		t.Errorf("got %v %v", texts(fs), err)
+	}
+	fs, err = s.Last(2, inRoom("a"))
+	if err != nil || !equal(texts(fs), []string{"a3", "a4"}) {
+		t.Errorf("Last got %v %v", texts(fs), err)
+	}
+}
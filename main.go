@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/liuc2050/easychat/auth"
 	"github.com/liuc2050/easychat/client"
+	"github.com/liuc2050/easychat/history"
+	"github.com/liuc2050/easychat/proto"
 	"github.com/liuc2050/easychat/server"
 	"github.com/liuc2050/easychat/ui"
+	"github.com/liuc2050/easychat/util"
 )
 
 type CmdFunc func([]string) error
@@ -22,15 +31,29 @@ type CmdEntry struct {
 }
 
 var cmds = map[string]CmdEntry{
-	"create": CmdEntry{Execute: createServer, Send: send, Help: "create [[ip][:]port]\t\tstart a server which listens on the local network address."},
-	"enter":  CmdEntry{Execute: enterServer, Send: send, Help: "enter [ip:port]\t\tconnect server"},
-	"leave":  CmdEntry{Execute: leaveServer, Help: "leave\t\tdisconnect server"},
-	"bye":    CmdEntry{Execute: bye, Help: "bye\t\texit program"},
+	"create":  CmdEntry{Execute: createServer, Send: send, Help: "create [-tls] [[ip][:]port|unix:path] [nick [password]]\t\tstart a server which listens on the local network address."},
+	"enter":   CmdEntry{Execute: enterServer, Send: send, Help: "enter [-tls] [ip:port|unix:path] [nick]\t\tconnect server"},
+	"login":   CmdEntry{Execute: loginServer, Send: send, Help: "login [-tls] ip:port|unix:path nick password\t\tconnect server with an account"},
+	"nick":    CmdEntry{Execute: changeNick, Send: send, Help: "nick name\t\tchange your nickname"},
+	"msg":     CmdEntry{Execute: directMsg, Send: sendDirect, Help: "msg nick [text]\t\tsend private messages to nick"},
+	"join":    CmdEntry{Execute: joinRoom, Send: send, Help: "join room\t\tjoin the room, messages will be sent to it"},
+	"part":    CmdEntry{Execute: partRoom, Send: send, Help: "part room\t\tpart the room"},
+	"who":     CmdEntry{Execute: who, Send: send, Help: "who [room]\t\tlist members online in the room or the whole server"},
+	"history": CmdEntry{Execute: showHistory, Send: send, Help: "history [n]\t\tshow last n messages of current room"},
+	"kick":    CmdEntry{Execute: moderate, Send: send, Help: "kick nick [reason]\t\tdisconnect nick (operator only)"},
+	"ban":     CmdEntry{Execute: moderate, Send: send, Help: "ban nick|ip\t\tban and disconnect nick or ip (operator only)"},
+	"unban":   CmdEntry{Execute: moderate, Send: send, Help: "unban nick|ip\t\tlift the ban (operator only)"},
+	"mute":    CmdEntry{Execute: moderate, Send: send, Help: "mute nick|ip\t\tforbid nick or ip to send messages (operator only)"},
+	"unmute":  CmdEntry{Execute: moderate, Send: send, Help: "unmute nick|ip\t\tallow nick or ip to send messages (operator only)"},
+	"op":      CmdEntry{Execute: moderate, Send: send, Help: "op nick\t\tmake nick an operator (operator only)"},
+	"leave":   CmdEntry{Execute: leaveServer, Help: "leave\t\tdisconnect server"},
+	"bye":     CmdEntry{Execute: bye, Help: "bye\t\texit program"},
 }
 
 var currentCmd string
 var srv *server.Server
 var cli *client.Client
+var directTo string //私聊对象
 var shouldExit chan struct{}
 
 type argsErr string
@@ -39,6 +62,15 @@ func (e *argsErr) Error() string {
 	return string(*e)
 }
 
+//clientErr 客户端命令的错误（如重连期间写入失败）只需提示，不应结束程序
+func clientErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	s := err.Error()
+	return (*argsErr)(&s)
+}
+
 type WriteFunc func(string)
 
 func (f WriteFunc) Write(p []byte) (n int, err error) {
@@ -47,42 +79,128 @@ func (f WriteFunc) Write(p []byte) (n int, err error) {
 	return len(s), nil
 }
 
+//notify 显示本地的通知，headless模式下输出到标准输出
+var notify = ui.Notify
+
+//output 非nil时为headless模式
+var output *printer
+
 var logger = log.New(WriteFunc(ui.Notify), "", log.LstdFlags)
 
 var fileName = flag.String("log", "", "log file name")
+var headless = flag.Bool("headless", false, "run without the terminal UI: read messages and :commands from stdin, print received messages to stdout")
+var outputFormat = flag.String("format", "plain", "with -headless, output format, one frame per line: plain (newlines escaped as \\n) or json")
+var linger = flag.Duration("linger", 0, "with -headless, keep printing received messages for this long after stdin ends, e.g. -linger 2s for replies to piped commands")
+var nickName = flag.String("nick", os.Getenv("USER"), "default nickname")
+var certFile = flag.String("cert", configPath("cert.pem"), "TLS certificate file of server, generated if not exist")
+var keyFile = flag.String("key", configPath("key.pem"), "TLS key file of server, generated if not exist")
+var caFile = flag.String("ca", "", "CA file to verify server certificate")
+var fingerprint = flag.String("fingerprint", "", "pinned sha256 fingerprint of server certificate")
+var historyFile = flag.String("history", "", "file to persist messages of created server, kept in memory if empty")
+var replay = flag.Int("replay", 20, "number of messages replayed when entering a room")
+var usersFile = flag.String("users", "", "account file of created server, login is disabled if empty")
+var anonymous = flag.Bool("anonymous", true, "allow unregistered nicks to enter the created server when -users is set")
+var addUser = flag.String("adduser", "", "add an account to -users file with the password read from stdin, then exit")
+var addToken = flag.Bool("token", false, "with -adduser, generate a random token as the password")
+var opNicks = flag.String("ops", "", "comma-separated operators of created server, a nick without account is granted to the first session entering with it")
+var bansFile = flag.String("bans", configPath("bans"), "file to persist bans of created server")
+var heartbeat = flag.Duration("heartbeat", 30*time.Second, "interval of ping heartbeats")
+var idleTimeout = flag.Duration("timeout", 90*time.Second, "disconnect peers sending nothing for this long, must be greater than -heartbeat")
+var slowPolicy = flag.String("slow", "disconnect", "policy of created server for clients too slow to receive: drop-oldest, drop-newest, disconnect or block")
+var slowThreshold = flag.Int("slow-threshold", 100, "with -slow=disconnect, frames dropped before disconnecting")
+var slowTimeout = flag.Duration("slow-timeout", time.Second, "with -slow=block, time to wait before disconnecting")
+var rateMessages = flag.Float64("rate", 10, "messages per second allowed for each client of created server, 0 for unlimited")
+var rateBytes = flag.Float64("rate-bytes", 32<<10, "bytes per second allowed for each client of created server, 0 for unlimited")
+var shutdownGrace = flag.Duration("shutdown-grace", 0, "time between announcing the shutdown of created server and closing connections")
+var maxMessage = flag.Int("max-message", 64<<10, "max bytes of a message accepted by created server")
+var knownHosts = flag.String("known-hosts", configPath("known_hosts"), "trust-on-first-use fingerprints of servers")
+
+//logFile -log打开的文件，serve模式下收到SIGHUP时重新打开
+var logFile *os.File
+
+//openLog 以追加方式打开日志文件
+func openLog(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+//configPath 配置文件默认存放在~/.easychat下
+func configPath(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return name
+	}
+	return filepath.Join(home, ".easychat", name)
+}
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags]\n       %s [flags] serve [-tls] [ip][:]port|unix:path\n"+
+			"serve shuts down gracefully on SIGINT or SIGTERM (a second one quits immediately); SIGHUP only reopens the -log file and rereads the users and bans files, other flags need a restart\n",
+			os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	if len(*addUser) > 0 {
+		if err := addAccount(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	if len(*fileName) > 0 {
-		file, err := os.OpenFile(*fileName, os.O_WRONLY|os.O_CREATE, os.ModePerm)
-		if err != nil {
+		var err error
+		if logFile, err = openLog(*fileName); err != nil {
 			panic(err)
 		}
-		defer file.Close()
-		logger = log.New(file, "", log.LstdFlags)
+		defer func() { logFile.Close() }()
+		logger = log.New(logFile, "", log.LstdFlags)
+	} else if *headless {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	} else if flag.Arg(0) == "serve" {
+		logger = log.New(os.Stdout, "", log.LstdFlags)
+	}
+	if flag.Arg(0) == "serve" {
+		if err := runDaemon(flag.Args()); err != nil {
+			logger.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	shouldExit = make(chan struct{})
+	if *headless {
+		var err error
+		if output, err = newPrinter(os.Stdout, *outputFormat); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		notify = output.notice
+		if err := runHeadless(os.Stdin); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
 	ui.Init(logger)
 	defer ui.Close()
 	helpInfo()
 	go ui.Draw()
-	shouldExit = make(chan struct{})
 	for {
 		out, isCmd, err := ui.Scan()
 		if err != nil {
-			ui.Notify(err.Error())
+			notify(err.Error())
 			continue
 		}
 		if isCmd {
 			if err := executeCmd(out); err != nil {
 				if e, ok := err.(*argsErr); ok {
-					ui.Notify(e.Error())
+					notify(e.Error())
 					continue
 				}
 				panic(err)
 			}
 		} else {
 			if err := sendMsg(out[0]); err != nil {
-				ui.Notify(err.Error())
+				notify(err.Error())
 				continue
 			}
 		}
@@ -96,10 +214,34 @@ func main() {
 	}
 }
 
+//addAccount 向-users文件添加账户，密码从标准输入读取或随机生成令牌
+func addAccount() error {
+	if len(*usersFile) == 0 {
+		return errors.New("addAccount: -users is required")
+	}
+	users, err := auth.OpenFile(*usersFile)
+	if err != nil {
+		return err
+	}
+	var secret string
+	if *addToken {
+		secret = auth.NewToken()
+		fmt.Println(secret)
+	} else {
+		fmt.Fprintf(os.Stderr, "password for %s: ", *addUser)
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return err
+		}
+		secret = strings.TrimRight(line, "\r\n")
+	}
+	return users.Add(*addUser, secret)
+}
+
 func helpInfo() {
-	ui.Notify("A vim-style chatting program. At insert mode you can type message to send. At last-line mode you can type these commands:")
+	notify("A vim-style chatting program. At insert mode you can type message to send, Ctrl-J starts a new line of the message, the arrows, Home/End and Delete move and edit at the cursor, Ctrl-W deletes a word and Ctrl-U deletes to the start. At command mode (Esc) the message can be edited like vim: h/l/w/b/e/0/$ move, x, d, c, D, C and r change, a/A/i/I/o return to insert mode, a count repeats a motion and . repeats the last change; Ctrl-U/Ctrl-D, Ctrl-B/Ctrl-F and gg/G scroll the messages. At last-line mode you can type these commands:")
 	for _, v := range cmds {
-		ui.Notify(v.Help)
+		notify(v.Help)
 	}
 }
 
@@ -132,28 +274,181 @@ func sendMsg(msg string) error {
 	return cmdEntry.Send(msg)
 }
 
+func notifyFrame(f *proto.Frame) {
+	if f.Type == proto.TypePing || f.Type == proto.TypePong || f.Type == proto.TypePresence {
+		return
+	}
+	if output != nil {
+		output.frame(f)
+		return
+	}
+	notify(f.String())
+}
+
+//nickArg 取命令中可选的昵称参数
+func nickArg(args []string, i int) string {
+	if len(args) > i {
+		return args[i]
+	}
+	return *nickName
+}
+
+//tlsArg 去掉命令中的-tls选项，返回是否启用TLS
+func tlsArg(args []string) ([]string, bool) {
+	out := make([]string, 0, len(args))
+	var useTLS bool
+	for _, arg := range args {
+		if arg == "-tls" {
+			useTLS = true
+			continue
+		}
+		out = append(out, arg)
+	}
+	return out, useTLS
+}
+
 func createServer(args []string) error {
-	if len(args) != 2 {
-		s := "createServer: len(args) should be 2"
+	args, useTLS := tlsArg(args)
+	if len(args) < 2 || len(args) > 4 {
+		s := "createServer: len(args) should be 2, 3 or 4"
+		return (*argsErr)(&s)
+	}
+	var err error
+	//创建者默认是管理员
+	if srv, err = buildServer(args[1], nickArg(args, 2)); err != nil {
+		s := err.Error()
 		return (*argsErr)(&s)
 	}
-	srv = server.New(args[1], logger)
-	err := srv.Start()
+	//失败时释放服务器（包括打开的历史文件），只提示错误
+	fail := func(err error) error {
+		srv.ShutDown()
+		srv = nil
+		s := err.Error()
+		return (*argsErr)(&s)
+	}
+	var fp string
+	if useTLS {
+		if fp, err = srv.UseTLS(*certFile, *keyFile); err != nil {
+			return fail(err)
+		}
+	}
+	if err := srv.Start(); err != nil {
+		//如Unix套接字文件已存在、没有权限监听特权端口
+		return fail(err)
+	}
+	notify(fmt.Sprintf("server[%s] is listening.", srv.Addr()))
+	cli = client.New(util.DialAddr(srv.Addr()), nickArg(args, 2), logger, notifyFrame)
+	cli.SetHeartbeat(*heartbeat, *idleTimeout)
+	if len(args) == 4 {
+		cli.Login(args[3])
+	}
+	if useTLS {
+		notify("server certificate fingerprint: " + fp)
+		//本地客户端直接固定自己的证书
+		cli.UseTLS(client.TLSConfig{Fingerprint: fp})
+	}
+	if err := cli.EnterServer(); err != nil {
+		cli = nil
+		return fail(err)
+	}
+	return nil
+}
+
+//buildServer 按命令行参数创建监听addr的服务器，ops为额外的管理员
+func buildServer(addr string, ops ...string) (*server.Server, error) {
+	policy, err := server.ParseSlowPolicy(*slowPolicy)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	opts := server.Options{
+		Addr:          addr,
+		Heartbeat:     *heartbeat,
+		IdleTimeout:   *idleTimeout,
+		ShutdownGrace: *shutdownGrace,
+		Replay:        *replay,
+		Anonymous:     *anonymous,
+		BansFile:      *bansFile,
+		Ops:           ops,
+		SlowConsumer:  &server.SlowConsumer{Policy: policy, Threshold: *slowThreshold, Timeout: *slowTimeout},
+		RateLimit:     &server.RateLimit{Messages: *rateMessages, Bytes: *rateBytes, Warn: 3, Kick: 30},
+		MaxMessage:    *maxMessage,
+	}
+	for _, nick := range strings.Split(*opNicks, ",") {
+		if nick = strings.TrimSpace(nick); len(nick) > 0 {
+			opts.Ops = append(opts.Ops, nick)
+		}
+	}
+	if len(*historyFile) > 0 {
+		if opts.History, err = history.OpenFile(*historyFile); err != nil {
+			return nil, err
+		}
 	}
-	ui.Notify(fmt.Sprintf("server[%s] is listening.", args[1]))
-	cli = client.New("localhost:"+args[1], logger, ui.Notify)
-	return cli.EnterServer()
+	if len(*usersFile) > 0 {
+		if opts.Users, err = auth.OpenFile(*usersFile); err != nil {
+			if opts.History != nil {
+				opts.History.Close()
+			}
+			return nil, err
+		}
+	}
+	return server.NewWithOptions(opts, logger)
 }
 
 func enterServer(args []string) error {
+	args, useTLS := tlsArg(args)
+	if len(args) != 2 && len(args) != 3 {
+		s := "enterServer: len(args) should be 2 or 3"
+		return (*argsErr)(&s)
+	}
+	return connect(args[1], nickArg(args, 2), "", useTLS)
+}
+
+func loginServer(args []string) error {
+	args, useTLS := tlsArg(args)
+	if len(args) != 4 {
+		s := "loginServer: len(args) should be 4"
+		return (*argsErr)(&s)
+	}
+	return connect(args[1], args[2], args[3], useTLS)
+}
+
+//connect 连接服务器，password非空时用于登录
+func connect(addr, nick, password string, useTLS bool) error {
+	cli = client.New(addr, nick, logger, notifyFrame)
+	if err := cli.SetHeartbeat(*heartbeat, *idleTimeout); err != nil {
+		cli = nil
+		s := err.Error()
+		return (*argsErr)(&s)
+	}
+	if len(password) > 0 {
+		cli.Login(password)
+	}
+	if useTLS {
+		conf := client.TLSConfig{CAFile: *caFile, Fingerprint: *fingerprint, KnownHosts: *knownHosts}
+		if err := cli.UseTLS(conf); err != nil {
+			cli = nil
+			s := err.Error()
+			return (*argsErr)(&s)
+		}
+	}
+	if err := cli.EnterServer(); err != nil {
+		cli = nil
+		s := err.Error()
+		return (*argsErr)(&s)
+	}
+	return nil
+}
+
+func changeNick(args []string) error {
 	if len(args) != 2 {
-		s := "enterServer: len(args) should be 2"
+		s := "changeNick: len(args) should be 2"
 		return (*argsErr)(&s)
 	}
-	cli = client.New(args[1], logger, ui.Notify)
-	return cli.EnterServer()
+	if cli == nil {
+		s := "changeNick: not connected to any server"
+		return (*argsErr)(&s)
+	}
+	return clientErr(cli.Nick(args[1]))
 }
 
 func send(msg string) error {
@@ -163,24 +458,133 @@ func send(msg string) error {
 	return cli.Send(msg)
 }
 
-func leaveServer(args []string) error {
+func joinRoom(args []string) error {
+	if len(args) != 2 {
+		s := "joinRoom: len(args) should be 2"
+		return (*argsErr)(&s)
+	}
+	if cli == nil {
+		s := "joinRoom: not connected to any server"
+		return (*argsErr)(&s)
+	}
+	return clientErr(cli.Join(args[1]))
+}
+
+func partRoom(args []string) error {
+	if len(args) != 2 {
+		s := "partRoom: len(args) should be 2"
+		return (*argsErr)(&s)
+	}
 	if cli == nil {
+		s := "partRoom: not connected to any server"
+		return (*argsErr)(&s)
+	}
+	return clientErr(cli.Part(args[1]))
+}
+
+func directMsg(args []string) error {
+	if len(args) < 2 {
+		s := "directMsg: len(args) should be at least 2"
+		return (*argsErr)(&s)
+	}
+	if cli == nil {
+		s := "directMsg: not connected to any server"
+		return (*argsErr)(&s)
+	}
+	directTo = args[1]
+	if len(args) == 2 {
 		return nil
 	}
-	if err := cli.LeaveServer(); err != nil {
-		return err
+	return clientErr(cli.SendDirect(directTo, strings.Join(args[2:], " ")))
+}
+
+func sendDirect(msg string) error {
+	if cli == nil {
+		return errors.New("sendDirect: cli is nil")
+	}
+	return cli.SendDirect(directTo, msg)
+}
+
+func who(args []string) error {
+	if len(args) > 2 {
+		s := "who: len(args) should be 1 or 2"
+		return (*argsErr)(&s)
+	}
+	if cli == nil {
+		s := "who: not connected to any server"
+		return (*argsErr)(&s)
+	}
+	var room string
+	if len(args) == 2 {
+		room = args[1]
+	}
+	return clientErr(cli.Who(room))
+}
+
+func showHistory(args []string) error {
+	if len(args) > 2 {
+		s := "showHistory: len(args) should be 1 or 2"
+		return (*argsErr)(&s)
+	}
+	if cli == nil {
+		s := "showHistory: not connected to any server"
+		return (*argsErr)(&s)
 	}
+	var n int
+	if len(args) == 2 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n <= 0 {
+			s := fmt.Sprintf("showHistory: invalid number[%s]", args[1])
+			return (*argsErr)(&s)
+		}
+	}
+	return clientErr(cli.History(n))
+}
+
+//moderate 管理命令，由服务端检查是否为管理员
+func moderate(args []string) error {
+	if len(args) < 2 || (args[0] != "kick" && len(args) != 2) {
+		s := fmt.Sprintf("moderate: invalid arguments of %s", args[0])
+		return (*argsErr)(&s)
+	}
+	if cli == nil {
+		s := "moderate: not connected to any server"
+		return (*argsErr)(&s)
+	}
+	switch args[0] {
+	case "kick":
+		return clientErr(cli.Kick(args[1], strings.Join(args[2:], " ")))
+	case "ban":
+		return clientErr(cli.Ban(args[1]))
+	case "unban":
+		return clientErr(cli.Unban(args[1]))
+	case "mute":
+		return clientErr(cli.Mute(args[1]))
+	case "unmute":
+		return clientErr(cli.Unmute(args[1]))
+	default:
+		return clientErr(cli.Op(args[1]))
+	}
+}
+
+func leaveServer(args []string) error {
+	if cli == nil {
+		return nil
+	}
+	//重连期间连接已关闭，出错时也已离开
+	err := cli.LeaveServer()
 	cli = nil
 	if srv != nil {
 		srv.ShutDown()
 		srv = nil
 	}
-	return nil
+	return clientErr(err)
 }
 
 func bye(args []string) error {
+	//离开出错也要退出
 	if err := leaveServer(args); err != nil {
-		return err
+		notify(err.Error())
 	}
 	close(shouldExit)
 	return nil
@@ -0,0 +1,80 @@
+//Package memnet 基于net.Pipe的内存传输，用于不占用端口地运行和测试服务端与客户端
+package memnet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+//ErrClosed Listener已关闭
+var ErrClosed = errors.New("memnet: listener closed")
+
+//Addr 内存监听地址
+type Addr string
+
+func (a Addr) Network() string { return "memnet" }
+func (a Addr) String() string  { return string(a) }
+
+//Listener 实现net.Listener，Dial得到的连接由Accept返回
+type Listener struct {
+	addr   Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+//Listen 创建名为name的内存监听
+func Listen(name string) *Listener {
+	return &Listener{addr: Addr(name), conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	if l == nil {
+		return nil, errors.New("Listener.Accept: l is nil")
+	}
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	if l == nil {
+		return errors.New("Listener.Close: l is nil")
+	}
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+//Dial 建立到l的连接，阻塞到被Accept或l关闭，参数被忽略
+func (l *Listener) Dial(network, address string) (net.Conn, error) {
+	return l.DialContext(context.Background(), network, address)
+}
+
+//DialContext 同Dial，ctx结束时返回ctx.Err()，可直接用作client.Dialer
+func (l *Listener) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if l == nil {
+		return nil, errors.New("Listener.Dial: l is nil")
+	}
+	local, remote := net.Pipe()
+	select {
+	case l.conns <- remote:
+		return local, nil
+	case <-l.closed:
+		local.Close()
+		remote.Close()
+		return nil, ErrClosed
+	case <-ctx.Done():
+		local.Close()
+		remote.Close()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,43 @@
+package memnet
+
+import (
+	"io"
+	"testing"
+)
+
+func TestListener(t *testing.T) {
+	ln := Listen("chat")
+	if ln.Addr().String() != "chat" || ln.Addr().Network() != "memnet" {
+		t.Errorf("Addr got %s %s", ln.Addr().Network(), ln.Addr())
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Accept error:%v", err)
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	conn, err := ln.Dial("", "")
+	if err != nil {
+		t.Fatalf("Dial error:%v", err)
+	}
+	if _, err := conn.Write([]byte("hi")); err != nil {
+		t.Fatalf("Write error:%v", err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hi" {
+		t.Errorf("Read got %q %v, want hi", buf, err)
+	}
+	conn.Close()
+
+	ln.Close()
+	ln.Close()
+	if _, err := ln.Accept(); err != ErrClosed {
+		t.Errorf("Accept after Close got %v, want ErrClosed", err)
+	}
+	if _, err := ln.Dial("", ""); err != ErrClosed {
+		t.Errorf("Dial after Close got %v, want ErrClosed", err)
+	}
+}
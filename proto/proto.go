@@ -0,0 +1,226 @@
+//Package proto 定义客户端与服务端之间的帧协议
+//每帧为4字节大端长度加JSON编码的Frame
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+//Version 当前协议版本
+const Version = 1
+
+//MaxFrameSize 默认的最大帧长度
+const MaxFrameSize = 1 << 20
+
+const headerLen = 4
+
+//MaxEscape JSON编码后文本中每字节最多占用的字节数，控制字符转义为\u00XX
+const MaxEscape = 6
+
+type Type string
+
+const (
+	TypeHello    Type = "hello"    //客户端握手，From为昵称，重连时Text为会话、ID为最后收到的消息、Epoch为其所属的纪元、Rooms为已加入的房间
+	TypeWelcome  Type = "welcome"  //握手成功，From为昵称，Text为会话，Count为消息文本的最大字节数，Epoch为消息ID的纪元
+	TypeAuth     Type = "auth"     //服务端要求登录；客户端回复时Text为密码或令牌
+	TypeMsg      Type = "msg"      //聊天消息，Text可以包含换行
+	TypeDirect   Type = "direct"   //私聊消息，To为接收者昵称
+	TypeNotice   Type = "notice"   //系统通知
+	TypeJoin     Type = "join"     //加入房间
+	TypePart     Type = "part"     //退出房间，Text为原因
+	TypeNick     Type = "nick"     //修改昵称，From为旧昵称，Text为新昵称
+	TypeError    Type = "error"    //错误，Text为原因
+	TypeHistory  Type = "history"  //请求Room中最近Count条历史消息
+	TypeKick     Type = "kick"     //管理员踢出To，Text为原因
+	TypeBan      Type = "ban"      //管理员封禁昵称或IP To，并踢出
+	TypeUnban    Type = "unban"    //管理员解封To
+	TypeMute     Type = "mute"     //管理员禁言To
+	TypeUnmute   Type = "unmute"   //管理员解除To的禁言
+	TypeOp       Type = "op"       //将To设为管理员
+	TypeWho      Type = "who"      //查询Room中的在线成员，Room为空则查询整个服务器；回复时Members为结果
+	TypePresence Type = "presence" //成员变化，Text为online、offline、update或roster，From为变化前的昵称
+	TypeClose    Type = "close"    //服务端关闭连接前的最后一帧，Text为原因
+	TypePing     Type = "ping"
+	TypePong     Type = "pong"
+)
+
+type Frame struct {
+	V    int       `json:"v"`
+	ID   uint64    `json:"id,omitempty"` //服务端保存消息时分配
+	Type Type      `json:"type"`
+	From string    `json:"from,omitempty"`
+	To   string    `json:"to,omitempty"`
+	Room string    `json:"room,omitempty"`
+	Time time.Time `json:"time"`
+	Text string    `json:"text,omitempty"`
+
+	Count   int      `json:"count,omitempty"`
+	Epoch   string   `json:"epoch,omitempty"` //消息ID的纪元，服务端重启后ID可能重新开始
+	Rooms   []string `json:"rooms,omitempty"`
+	Members []Member `json:"members,omitempty"`
+}
+
+//Member 在线成员的状态
+type Member struct {
+	Nick  string        `json:"nick"`
+	Addr  string        `json:"addr,omitempty"`
+	Since time.Time     `json:"since"` //进入服务器的时间
+	Idle  time.Duration `json:"idle"`  //距最后一次发言的时间
+	Rooms []string      `json:"rooms,omitempty"`
+	Queue int           `json:"queue,omitempty"` //服务端待发送给该成员的帧数
+}
+
+//presence的Text
+const (
+	PresenceOnline  = "online"  //Members[0]进入服务器
+	PresenceOffline = "offline" //From离开服务器
+	PresenceUpdate  = "update"  //From改名或加入、退出房间，Members[0]为新的状态
+	PresenceRoster  = "roster"  //进入服务器时收到的完整成员列表
+)
+
+var ErrVersion = errors.New("proto: unsupported version")
+var ErrTooLarge = errors.New("proto: frame too large")
+
+//New 创建当前版本、当前时间的帧
+func New(t Type, from, room, text string) *Frame {
+	return &Frame{V: Version, Type: t, From: from, Room: room, Time: time.Now(), Text: text}
+}
+
+//Write 将帧编码后一次写入w
+func Write(w io.Writer, f *Frame) error {
+	if f == nil {
+		return errors.New("proto.Write: f is nil")
+	}
+	//<>&等不转义，只有控制字符、引号和反斜杠会变长
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(f); err != nil {
+		return err
+	}
+	body := bytes.TrimSuffix(b.Bytes(), []byte{'\n'})
+	buf := make([]byte, headerLen+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	copy(buf[headerLen:], body)
+	_, err := w.Write(buf)
+	return err
+}
+
+type Reader struct {
+	r    *bufio.Reader
+	max  int
+	size int //最后读取的一帧在连接上的字节数
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r), max: MaxFrameSize}
+}
+
+//Read 读取下一帧，连接正常关闭时返回io.EOF
+//帧过长时丢弃该帧并返回ErrTooLarge，之后可继续读取
+func (r *Reader) Read() (*Frame, error) {
+	var header [headerLen]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return nil, err
+	}
+	n := int64(binary.BigEndian.Uint32(header[:]))
+	r.size = headerLen + int(n)
+	if n > int64(r.max) {
+		if _, err := io.CopyN(io.Discard, r.r, n); err != nil {
+			return nil, err
+		}
+		return nil, ErrTooLarge
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	f := new(Frame)
+	if err := json.Unmarshal(body, f); err != nil {
+		return nil, err
+	}
+	if f.V != Version {
+		return nil, ErrVersion
+	}
+	return f, nil
+}
+
+//Size 最后读取的一帧在连接上的字节数（包括头部），过长被丢弃的帧也计算在内，用于限流
+func (r *Reader) Size() int {
+	return r.size
+}
+
+//String 用于显示的文本
+func (f *Frame) String() string {
+	if f == nil {
+		return ""
+	}
+	var room string
+	if len(f.Room) > 0 {
+		room = "#" + f.Room + " "
+	}
+	ts := f.Time.Format("15:04:05 ")
+	switch f.Type {
+	case TypeMsg:
+		return ts + room + "[" + f.From + "]: " + f.Text
+	case TypeDirect:
+		return ts + "[" + f.From + "] -> [" + f.To + "]: " + f.Text
+	case TypeNotice:
+		return ts + room + f.Text
+	case TypeJoin:
+		return ts + room + "[" + f.From + "] is entering."
+	case TypePart:
+		if len(f.Text) > 0 {
+			return ts + room + "[" + f.From + "] has left (" + f.Text + ")."
+		}
+		return ts + room + "[" + f.From + "] has left."
+	case TypeNick:
+		return ts + "[" + f.From + "] is now known as [" + f.Text + "]."
+	case TypeWelcome:
+		return ts + "welcome, [" + f.From + "]."
+	case TypeKick, TypeBan, TypeUnban, TypeMute, TypeUnmute:
+		s := ts + "[" + f.From + "] " + string(f.Type) + "s [" + f.To + "]"
+		if len(f.Text) > 0 {
+			s += " (" + f.Text + ")"
+		}
+		return s + "."
+	case TypeWho:
+		var b strings.Builder
+		b.WriteString(ts + room + fmt.Sprintf("%d member(s) online:", len(f.Members)))
+		for _, m := range f.Members {
+			b.WriteString(fmt.Sprintf("\n  [%s] %s since %s, idle %s", m.Nick, m.Addr,
+				m.Since.Format("15:04:05"), m.Idle.Truncate(time.Second)))
+			for _, r := range m.Rooms {
+				b.WriteString(" #" + r)
+			}
+			if m.Queue > 0 {
+				b.WriteString(fmt.Sprintf(", %d queued", m.Queue))
+			}
+		}
+		return b.String()
+	case TypePresence:
+		return ts + "[" + f.From + "] " + f.Text + "."
+	case TypeOp:
+		return ts + "[" + f.From + "] makes [" + f.To + "] an operator."
+	case TypeClose:
+		if len(f.Text) > 0 {
+			return ts + "server closed the connection (" + f.Text + ")."
+		}
+		return ts + "server closed the connection."
+	case TypeError:
+		return ts + room + "error: " + f.Text
+	default:
+		return fmt.Sprintf("%s%s[%s] %s", ts, room, f.Type, f.Text)
+	}
+}
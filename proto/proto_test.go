@@ -0,0 +1,112 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteRead(t *testing.T) {
+	var buf bytes.Buffer
+	frames := []*Frame{
+		New(TypeHello, "tom", "", ""),
+		New(TypeMsg, "tom", "go", "第一行\n第二行"),
+		New(TypePart, "jerry", "lobby", "server shutting down"),
+	}
+	for _, f := range frames {
+		if err := Write(&buf, f); err != nil {
+			t.Fatalf("Write error:%v", err)
+		}
+	}
+	if err := Write(&buf, nil); err == nil {
+		t.Errorf("when f nil, should return error")
+	}
+	//HTML字符不转义，控制字符最多变为MaxEscape倍
+	var escaped bytes.Buffer
+	Write(&escaped, New(TypeMsg, "", "", "<>&"))
+	if !bytes.Contains(escaped.Bytes(), []byte(`"<>&"`)) {
+		t.Errorf("got %q, want <>& unescaped", escaped.Bytes())
+	}
+	escaped.Reset()
+	Write(&escaped, New(TypeMsg, "", "", "\x01\x01"))
+	if !bytes.Contains(escaped.Bytes(), []byte(`"\u0001\u0001"`)) {
+		t.Errorf("got %q, want %d bytes per control character", escaped.Bytes(), MaxEscape)
+	}
+	r := NewReader(&buf)
+	for _, want := range frames {
+		got, err := r.Read()
+		if err != nil {
+			t.Fatalf("Read error:%v", err)
+		}
+		if got.Type != want.Type || got.From != want.From || got.Room != want.Room ||
+			got.Text != want.Text || !got.Time.Equal(want.Time) || got.V != Version {
+			t.Errorf("got %#v, want %#v", got, want)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	f := New(TypeMsg, "tom", "", strings.Repeat("x", 256))
+	Write(&buf, f)
+	Write(&buf, &Frame{V: Version + 1, Type: TypeMsg})
+	Write(&buf, New(TypePing, "", "", ""))
+	var header [headerLen]byte
+	binary.BigEndian.PutUint32(header[:], 10)
+	buf.Write(header[:])
+	buf.WriteString("{")
+
+	r := NewReader(&buf)
+	r.max = 128
+	if _, err := r.Read(); err != ErrTooLarge {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+	if r.Size() <= 256+headerLen {
+		t.Errorf("discarded frame size got %d, want more than %d", r.Size(), 256+headerLen)
+	}
+	if _, err := r.Read(); err != ErrVersion {
+		t.Errorf("got %v, want ErrVersion", err)
+	}
+	//过长的帧被丢弃后可继续读取
+	if got, err := r.Read(); err != nil || got.Type != TypePing {
+		t.Errorf("got %v %v, want ping", got, err)
+	}
+	if _, err := r.Read(); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+func TestString(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 15, 4, 5, 0, time.Local)
+	tests := []struct {
+		f    *Frame
+		want string
+	}{
+		{&Frame{Type: TypeMsg, From: "tom", Room: "go", Time: ts, Text: "hi"}, "15:04:05 #go [tom]: hi"},
+		{&Frame{Type: TypeDirect, From: "tom", To: "jerry", Time: ts, Text: "hi"}, "15:04:05 [tom] -> [jerry]: hi"},
+		{&Frame{Type: TypeJoin, From: "tom", Room: "go", Time: ts}, "15:04:05 #go [tom] is entering."},
+		{&Frame{Type: TypePart, From: "tom", Room: "go", Time: ts}, "15:04:05 #go [tom] has left."},
+		{&Frame{Type: TypePart, From: "tom", Room: "go", Time: ts, Text: "quit"}, "15:04:05 #go [tom] has left (quit)."},
+		{&Frame{Type: TypeNick, From: "tom", Time: ts, Text: "jerry"}, "15:04:05 [tom] is now known as [jerry]."},
+		{&Frame{Type: TypeKick, From: "tom", To: "jerry", Time: ts, Text: "spam"}, "15:04:05 [tom] kicks [jerry] (spam)."},
+		{&Frame{Type: TypeBan, From: "tom", To: "10.0.0.1", Time: ts}, "15:04:05 [tom] bans [10.0.0.1]."},
+		{&Frame{Type: TypeOp, From: "tom", To: "jerry", Time: ts}, "15:04:05 [tom] makes [jerry] an operator."},
+		{&Frame{Type: TypeWho, Room: "go", Time: ts, Members: []Member{{Nick: "tom", Addr: "127.0.0.1:80", Since: ts, Idle: 90 * time.Second, Rooms: []string{"go", "lobby"}}}},
+			"15:04:05 #go 1 member(s) online:\n  [tom] 127.0.0.1:80 since 15:04:05, idle 1m30s #go #lobby"},
+		{&Frame{Type: TypeError, Time: ts, Text: "oops"}, "15:04:05 error: oops"},
+		{&Frame{Type: TypeClose, Time: ts, Text: "server shutting down"}, "15:04:05 server closed the connection (server shutting down)."},
+		{&Frame{Type: TypeClose, Time: ts}, "15:04:05 server closed the connection."},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		if got := test.f.String(); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
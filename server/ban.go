@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//banList 被封禁的昵称或IP，path非空时保存到文件，每行一个
+type banList struct {
+	mu   sync.Mutex
+	path string
+	set  map[string]bool
+}
+
+//loadBans 读取封禁文件，不存在时视为空
+func loadBans(path string) (*banList, error) {
+	set, err := readBans(path)
+	if err != nil {
+		return nil, err
+	}
+	return &banList{path: path, set: set}, nil
+}
+
+func readBans(path string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	if len(path) == 0 {
+		return set, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return set, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if target := strings.TrimSpace(scanner.Text()); len(target) > 0 {
+			set[target] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+//reload 重新读取封禁文件，用于外部修改了文件之后
+func (b *banList) reload() error {
+	set, err := readBans(b.path)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.set = set
+	b.mu.Unlock()
+	return nil
+}
+
+//banned 昵称或IP是否被封禁
+func (b *banList) banned(nick, ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.set[nick] || (len(ip) > 0 && b.set[ip])
+}
+
+//update 封禁或解封，返回是否有变化；保存失败时恢复原状
+func (b *banList) update(target string, ban bool) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.set[target] == ban {
+		return false, nil
+	}
+	set := func(ban bool) {
+		if ban {
+			b.set[target] = true
+		} else {
+			delete(b.set, target)
+		}
+	}
+	set(ban)
+	if err := b.save(); err != nil {
+		set(!ban)
+		return false, err
+	}
+	return true, nil
+}
+
+//save 整个重写，先写临时文件再替换，避免中断时丢失
+func (b *banList) save() error {
+	if len(b.path) == 0 {
+		return nil
+	}
+	targets := make([]string, 0, len(b.set))
+	for target := range b.set {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	//默认的文件在~/.easychat下，目录可能还不存在
+	if err := os.MkdirAll(filepath.Dir(b.path), 0700); err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(append(targets, ""), "\n")), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+//hostOf 连接的对端IP，Unix套接字、内存连接等没有IP时为空
+func hostOf(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//RateLimit 每个连接的限流，超限时先限速，连续超限Warn次后警告，Kick次后踢出
+type RateLimit struct {
+	Messages float64 //每秒帧数，<=0不限制
+	Bytes    float64 //每秒字节数，按帧在连接上的大小计算，<=0不限制
+	Warn     int     //连续超限多少次后警告，<=0不警告
+	Kick     int     //连续超限多少次后踢出，<=0不踢出
+}
+
+var defaultRateLimit = RateLimit{Messages: 10, Bytes: 32 << 10, Warn: 3, Kick: 30}
+
+func (r RateLimit) check() error {
+	if r.Kick > 0 && r.Warn > r.Kick {
+		return fmt.Errorf("warn[%d] should not be greater than kick[%d]", r.Warn, r.Kick)
+	}
+	return nil
+}
+
+//bucket 令牌桶，容量为1秒的量；允许欠账，使超过容量的单帧也能在等待后通过
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, now time.Time) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{rate: rate, tokens: rate, last: now}
+}
+
+//take 取n个令牌，返回需要等待的时间
+func (b *bucket) take(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+//limiter 一个连接的限流状态，只由该连接的读取goroutine使用
+type limiter struct {
+	conf       RateLimit
+	messages   *bucket
+	bytes      *bucket
+	violations int //连续超限的次数
+}
+
+func newLimiter(conf RateLimit) *limiter {
+	now := time.Now()
+	return &limiter{conf: conf, messages: newBucket(conf.Messages, now), bytes: newBucket(conf.Bytes, now)}
+}
+
+//limitAction 超限时的处理
+type limitAction int
+
+const (
+	limitPass     limitAction = iota //未超限
+	limitThrottle                    //等待后继续
+	limitWarn                        //警告并等待
+	limitKick                        //踢出
+)
+
+//take 记录收到的帧，size为帧在连接上的字节数，返回处理方式及需要等待的时间
+//invalid的帧（如过长被丢弃）即使未超速也算一次超限
+func (l *limiter) take(size int, invalid bool) (limitAction, time.Duration) {
+	now := time.Now()
+	wait := l.messages.take(1, now)
+	if d := l.bytes.take(float64(size), now); d > wait {
+		wait = d
+	}
+	if wait == 0 && !invalid {
+		l.violations = 0
+		return limitPass, 0
+	}
+	l.violations++
+	switch {
+	case l.conf.Kick > 0 && l.violations >= l.conf.Kick:
+		return limitKick, wait
+	case l.violations == l.conf.Warn:
+		return limitWarn, wait
+	}
+	return limitThrottle, wait
+}
+
+const (
+	maxLoginFailures int           = 5           //登录连续失败多少次后暂时拒绝
+	loginBlock       time.Duration = time.Minute //从第一次失败起拒绝登录的时间
+)
+
+//loginLimit 按IP（没有IP时按昵称）记录登录失败，防止不断重连猜测密码
+type loginLimit struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailure
+}
+
+type loginFailure struct {
+	count int
+	since time.Time //第一次失败的时间
+}
+
+func newLoginLimit() *loginLimit {
+	return &loginLimit{failures: make(map[string]*loginFailure)}
+}
+
+//allow 是否允许key尝试登录
+func (l *loginLimit) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f := l.failures[key]
+	if f == nil {
+		return true
+	}
+	if now.Sub(f.since) >= loginBlock {
+		delete(l.failures, key)
+		return true
+	}
+	return f.count < maxLoginFailures
+}
+
+//fail 记录一次失败
+func (l *loginLimit) fail(key string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f := l.failures[key]
+	if f == nil || now.Sub(f.since) >= loginBlock {
+		f = &loginFailure{since: now}
+		l.failures[key] = f
+	}
+	f.count++
+	if len(l.failures) > 1024 {
+		//清理过期的记录，避免大量不同的IP占用内存
+		for k, f := range l.failures {
+			if now.Sub(f.since) >= loginBlock {
+				delete(l.failures, k)
+			}
+		}
+	}
+}
+
+//succeed 登录成功后清除失败记录
+func (l *loginLimit) succeed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+}
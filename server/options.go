@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/liuc2050/easychat/auth"
+	"github.com/liuc2050/easychat/history"
+	"github.com/liuc2050/easychat/util"
+)
+
+//Options 服务器的全部配置，零值字段使用默认值
+type Options struct {
+	Addr     string       //监听地址，格式见util.ParseAddr，如"8080"、"[::1]:8080"、"unix:/tmp/chat.sock"，为空则是":0"
+	Listener net.Listener //非nil时忽略Addr，在Listener上接受连接
+
+	MessagesCap int //消息通道的容量，默认1024
+	ClientCap   int //每个客户端发送通道的容量，默认100
+	MaxClients  int //最大在线人数，0为不限制
+
+	HandshakeTimeout time.Duration //握手的超时，默认10s
+	Heartbeat        time.Duration //发送ping的间隔，默认30s
+	IdleTimeout      time.Duration //超过该时间未收到任何帧则断开，默认90s
+	ShutdownGrace    time.Duration //Shutdown时通知客户端后等待的时间，默认0
+
+	TLSConfig *tls.Config //非nil时监听TLS，优先于CertFile
+	CertFile  string      //非空时启用TLS，证书不存在则生成自签名证书
+	KeyFile   string
+
+	History history.Store //消息存储，默认内存中保存1000条
+	Replay  int           //进入服务器或房间时回放的消息条数，默认20
+
+	Users     auth.Store //非nil时启用账户
+	Anonymous bool       //启用账户时是否允许未注册的昵称
+	BansFile  string     //非空时封禁列表保存到该文件
+	Ops       []string   //管理员昵称
+
+	SlowConsumer *SlowConsumer //默认连续丢弃100帧后断开
+	RateLimit    *RateLimit    //默认每秒10条、32KB
+	MaxMessage   int           //消息文本的最大字节数，默认64KB
+}
+
+//NewWithOptions 按配置创建服务器，New(port, l)相当于只设置Addr为":"+port
+//opts.History由Server负责关闭，出错时也会关闭
+func NewWithOptions(opts Options, l *log.Logger) (*Server, error) {
+	if opts.MessagesCap < 0 || opts.ClientCap < 0 || opts.MaxClients < 0 {
+		if opts.History != nil {
+			opts.History.Close()
+		}
+		return nil, errors.New("NewWithOptions: capacity should not be negative")
+	}
+	if len(opts.Addr) == 0 {
+		opts.Addr = ":0"
+	}
+	if opts.MessagesCap == 0 {
+		opts.MessagesCap = capMessages
+	}
+	if opts.ClientCap == 0 {
+		opts.ClientCap = capClient
+	}
+	s := newServer(opts.Addr, l, opts.MessagesCap, opts.ClientCap)
+	s.ln = opts.Listener
+	s.maxClients = opts.MaxClients
+	if opts.HandshakeTimeout > 0 {
+		s.handshakeTimeout = opts.HandshakeTimeout
+	}
+
+	var errs []error
+	if _, _, err := util.ParseAddr(opts.Addr); err != nil && opts.Listener == nil {
+		errs = append(errs, err)
+	}
+	if opts.Heartbeat > 0 || opts.IdleTimeout > 0 {
+		heartbeat, timeout := opts.Heartbeat, opts.IdleTimeout
+		if heartbeat == 0 {
+			heartbeat = defaultHeartbeat
+		}
+		if timeout == 0 {
+			timeout = defaultIdleTimeout
+		}
+		errs = append(errs, s.SetHeartbeat(heartbeat, timeout))
+	}
+	if opts.TLSConfig != nil {
+		s.tlsConfig = opts.TLSConfig
+	} else if len(opts.CertFile) > 0 {
+		_, err := s.UseTLS(opts.CertFile, opts.KeyFile)
+		errs = append(errs, err)
+	}
+	if opts.History != nil {
+		replay := opts.Replay
+		if replay == 0 {
+			replay = defaultReplay
+		}
+		errs = append(errs, s.UseHistory(opts.History, replay))
+	} else if opts.Replay > 0 {
+		s.replay = opts.Replay
+	}
+	if opts.Users != nil {
+		errs = append(errs, s.UseAuth(opts.Users, opts.Anonymous))
+	}
+	if len(opts.BansFile) > 0 {
+		errs = append(errs, s.UseBans(opts.BansFile))
+	}
+	for _, nick := range opts.Ops {
+		errs = append(errs, s.AddOp(nick))
+	}
+	if c := opts.SlowConsumer; c != nil {
+		errs = append(errs, s.SetSlowConsumer(c.Policy, c.Threshold, c.Timeout))
+	}
+	if opts.RateLimit != nil {
+		errs = append(errs, s.SetRateLimit(*opts.RateLimit))
+	}
+	if opts.ShutdownGrace > 0 {
+		errs = append(errs, s.SetShutdownGrace(opts.ShutdownGrace))
+	}
+	if opts.MaxMessage > 0 {
+		errs = append(errs, s.SetMaxMessage(opts.MaxMessage))
+	}
+	if err := errors.Join(errs...); err != nil {
+		if opts.History != nil {
+			opts.History.Close()
+		}
+		return nil, err
+	}
+	return s, nil
+}
@@ -1,58 +1,354 @@
 package server
 
 import (
-	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/liuc2050/easychat/auth"
+	"github.com/liuc2050/easychat/history"
+	"github.com/liuc2050/easychat/proto"
 	"github.com/liuc2050/easychat/util"
 )
 
 type Server struct {
 	noCopy util.NoCopy
 
-	port               string //监听端口
+	addr               string //监听地址
 	ln                 net.Listener
 	stopper1, stopper2 *util.Stopper //分阶段的控制结束
+	closing            chan struct{} //Shutdown开始时关闭
+	closeOnce          sync.Once
+	drainBy            atomic.Int64 //Shutdown时发送已排队帧的截止时间（UnixNano），closing关闭前设置
+	serveErr           chan error   //Accept失败的错误，容量为1
 	logger             *log.Logger
+	tlsConfig          *tls.Config //非nil时监听TLS
 
-	entering chan client //client进入通知
-	leaving  chan client //client离开通知
-	messages chan string //消息广播通道
+	messages   chan message //消息通道（进入、离开、加入/退出房间及房间消息）
+	clientCap  int          //每个客户端发送通道的容量
+	maxClients int          //最大在线人数，0为不限制
+
+	handshakeTimeout time.Duration
+
+	slow SlowConsumer //客户端消费太慢时的处理
+	rate RateLimit    //每个连接的限流
+
+	maxMessage int //消息文本的最大字节数，可以包含换行
+
+	heartbeat   time.Duration //发送ping的间隔
+	idleTimeout time.Duration //超过该时间未收到任何帧则断开
+
+	shutdownGrace time.Duration //Shutdown时通知客户端后等待的时间
+
+	history history.Store //消息存储
+	replay  int           //进入服务器或房间时回放的消息条数
+	epoch   string        //消息ID的纪元，每个实例不同，重连时纪元不同则不按ID补发
+
+	users     auth.Store      //非nil时已注册的昵称需要登录
+	logins    *loginLimit     //登录失败的次数
+	bans      *banList        //被封禁的昵称或IP
+	ops       map[string]bool //管理员的账户或待授予的昵称，Start之后只由broadcast访问
+	anonymous bool            //启用账户时是否允许未注册的昵称
+
+	nickMu sync.Mutex
+	nicks  map[string]*session //已被占用的昵称
+}
+
+//session 连接的会话，断线重连时凭token接管仍被旧连接占用的昵称
+type session struct {
+	token  string
+	conn   net.Conn
+	kicked chan struct{} //被踢出时由broadcast关闭
+	reason string        //断开的原因，kicked关闭前设置
+	nick   string        //占用的昵称，由nickMu保护
+
+	account string        //登录的账户，匿名为空
+	old     *session      //凭token接管的仍在线的旧会话
+	left    chan struct{} //离开消息入队后关闭
 }
 
 const (
 	//各通道cap值
-	capEntering int = 10
-	capLeaving  int = 1
 	capMessages int = 1024
 	capClient   int = 100
+
+	defaultHistory int = 1000 //默认内存存储的容量
+	defaultReplay  int = 20
+	maxHistory     int = 500 //单次请求历史消息的上限
+
+	defaultMaxMessage int = 64 << 10
+	//maxMessageLimit 最坏情况下文本每字节转义为proto.MaxEscape字节，其他字段留4KB，仍能放入一帧
+	maxMessageLimit int = (proto.MaxFrameSize - 4<<10) / proto.MaxEscape
+
+	maxNickLen              int           = 32
+	maxRoomLen              int           = 32
+	defaultHandshakeTimeout time.Duration = 10 * time.Second
+
+	defaultHeartbeat   time.Duration = 30 * time.Second
+	defaultIdleTimeout time.Duration = 90 * time.Second
+
+	defaultShutdownTimeout time.Duration = 10 * time.Second
+)
+
+var errLogin = errors.New("invalid nick or password")
+
+//DefaultRoom 客户端连接后默认所在的房间
+const DefaultRoom = "lobby"
+
+type client chan *proto.Frame //每个客户端消息发送通道，只由broadcast发送，按DropOldest丢弃时broadcast也会接收
+
+type msgKind int
+
+const (
+	msgEnter    msgKind = iota //客户端连接，进入默认房间
+	msgLeave                   //客户端断开，离开所有房间，text为原因
+	msgJoin                    //加入房间
+	msgPart                    //退出房间
+	msgText                    //房间内消息
+	msgReply                   //只回复给发送者的帧
+	msgNick                    //修改昵称，text为旧昵称
+	msgDirect                  //私聊，to为接收者昵称
+	msgHistory                 //请求房间的历史消息，count为条数
+	msgMod                     //管理操作，frame为操作帧
+	msgWho                     //查询在线成员，room为空则查询整个服务器
+	msgFlood                   //连续超过限流，踢出
+	msgAnnounce                //向所有客户端发送通知，text为内容，之后进入的客户端也会收到
 )
 
-type client chan<- string //只能发送操作（每个客户端消息发送通道）
+//message 同一连接的所有事件经由同一通道，保证处理顺序
+type message struct {
+	kind  msgKind
+	cli   client
+	name  string
+	room  string
+	text  string
+	to    string
+	count int
+	frame *proto.Frame //msgReply回复的帧
 
+	rooms []string //msgEnter时重新加入的房间
+	sess  *session //msgEnter时连接的会话
+	since uint64   //msgEnter时回放该ID之后的消息
+}
+
+//New 创建监听所有网卡上port端口的服务器，其余配置为默认值
 func New(port string, l *log.Logger) *Server {
-	return &Server{port: port,
-		stopper1: util.NewStopper(),
-		stopper2: util.NewStopper(),
-		logger:   l,
-		entering: make(chan client, capEntering),
-		leaving:  make(chan client, capLeaving),
-		messages: make(chan string, capMessages),
+	return newServer(":"+port, l, capMessages, capClient)
+}
+
+func newServer(addr string, l *log.Logger, messagesCap, clientCap int) *Server {
+	return &Server{addr: addr,
+		stopper1:  util.NewStopper(),
+		stopper2:  util.NewStopper(),
+		closing:   make(chan struct{}),
+		serveErr:  make(chan error, 1),
+		logger:    l,
+		messages:  make(chan message, messagesCap),
+		clientCap: clientCap,
+
+		handshakeTimeout: defaultHandshakeTimeout,
+
+		nicks:   make(map[string]*session),
+		bans:    &banList{set: make(map[string]bool)},
+		logins:  newLoginLimit(),
+		ops:     make(map[string]bool),
+		history: history.NewMemory(defaultHistory),
+		replay:  defaultReplay,
+		epoch:   newToken(),
+
+		slow: SlowConsumer{Policy: Disconnect, Threshold: defaultSlowThreshold, Timeout: defaultSlowTimeout},
+		rate: defaultRateLimit,
+
+		maxMessage: defaultMaxMessage,
+
+		heartbeat:   defaultHeartbeat,
+		idleTimeout: defaultIdleTimeout,
 	}
 }
 
-func (s *Server) Start() error {
+//UseHistory 替换消息存储，须在Start之前调用，store由Server负责关闭
+//replay为进入服务器或房间时回放的消息条数
+func (s *Server) UseHistory(store history.Store, replay int) error {
 	if s == nil {
-		return errors.New("Server.Start: s is nil")
+		return errors.New("Server.UseHistory: s is nil")
 	}
-	var err error
-	s.ln, err = net.Listen("tcp", ":"+s.port)
+	if store == nil {
+		return errors.New("Server.UseHistory: store is nil")
+	}
+	s.history.Close()
+	s.history, s.replay = store, replay
+	return nil
+}
+
+//UseAuth 启用账户，须在Start之前调用
+//anonymous为true时未注册的昵称仍可直接进入，否则只有账户可以进入
+func (s *Server) UseAuth(users auth.Store, anonymous bool) error {
+	if s == nil {
+		return errors.New("Server.UseAuth: s is nil")
+	}
+	if users == nil {
+		return errors.New("Server.UseAuth: users is nil")
+	}
+	s.users, s.anonymous = users, anonymous
+	return nil
+}
+
+//UseBans 从文件读取封禁列表，之后的封禁和解封都保存到该文件，须在Start之前调用
+func (s *Server) UseBans(path string) error {
+	if s == nil {
+		return errors.New("Server.UseBans: s is nil")
+	}
+	bans, err := loadBans(path)
 	if err != nil {
 		return err
 	}
+	s.bans = bans
+	return nil
+}
+
+//Reload 重新读取封禁文件，账户存储有Reload方法（如auth.File）时也重新读取，可在运行中调用
+func (s *Server) Reload() error {
+	if s == nil {
+		return errors.New("Server.Reload: s is nil")
+	}
+	var errs []error
+	if r, ok := s.users.(interface{ Reload() error }); ok {
+		errs = append(errs, r.Reload())
+	}
+	errs = append(errs, s.bans.reload())
+	return errors.Join(errs...)
+}
+
+//UseListener 在ln上接受连接而不是监听addr，如memnet.Listener，须在Start之前调用
+//ln由Server负责关闭，启用TLS时在ln之上握手
+func (s *Server) UseListener(ln net.Listener) error {
+	if s == nil {
+		return errors.New("Server.UseListener: s is nil")
+	}
+	if ln == nil {
+		return errors.New("Server.UseListener: ln is nil")
+	}
+	s.ln = ln
+	return nil
+}
+
+//AddOp 设置管理员，须在Start之前调用
+//nick为已注册的账户时，登录该账户的连接都是管理员；
+//否则只授予第一个以nick进入的会话，之后凭该会话的token重连仍是管理员
+func (s *Server) AddOp(nick string) error {
+	if s == nil {
+		return errors.New("Server.AddOp: s is nil")
+	}
+	if err := validNick(nick); err != nil {
+		return err
+	}
+	s.ops[nick] = true
+	return nil
+}
+
+//SetSlowConsumer 设置客户端发送通道已满时的策略，须在Start之前调用
+//threshold只用于Disconnect，timeout只用于Block
+func (s *Server) SetSlowConsumer(policy SlowPolicy, threshold int, timeout time.Duration) error {
+	if s == nil {
+		return errors.New("Server.SetSlowConsumer: s is nil")
+	}
+	switch {
+	case policy < DropOldest || policy > Block:
+		return fmt.Errorf("Server.SetSlowConsumer: invalid policy[%d]", policy)
+	case policy == Disconnect && threshold <= 0:
+		return fmt.Errorf("Server.SetSlowConsumer: invalid threshold[%d]", threshold)
+	case policy == Block && timeout <= 0:
+		return fmt.Errorf("Server.SetSlowConsumer: invalid timeout[%v]", timeout)
+	}
+	s.slow = SlowConsumer{Policy: policy, Threshold: threshold, Timeout: timeout}
+	return nil
+}
+
+//SetRateLimit 设置每个连接的限流，须在Start之前调用
+func (s *Server) SetRateLimit(rate RateLimit) error {
+	if s == nil {
+		return errors.New("Server.SetRateLimit: s is nil")
+	}
+	if err := rate.check(); err != nil {
+		return fmt.Errorf("Server.SetRateLimit: %v", err)
+	}
+	s.rate = rate
+	return nil
+}
+
+//SetMaxMessage 设置消息文本的最大字节数，须在Start之前调用
+//超过的消息回复error帧，不断开连接；JSON转义后须能放入一帧，因此不能超过maxMessageLimit
+func (s *Server) SetMaxMessage(n int) error {
+	if s == nil {
+		return errors.New("Server.SetMaxMessage: s is nil")
+	}
+	if n <= 0 || n > maxMessageLimit {
+		return fmt.Errorf("Server.SetMaxMessage: size should be in [1, %d]", maxMessageLimit)
+	}
+	s.maxMessage = n
+	return nil
+}
+
+//SetHeartbeat 设置ping间隔和空闲超时，须在Start之前调用
+//timeout应大于interval，客户端在timeout内没有任何帧（包括pong）则被断开
+func (s *Server) SetHeartbeat(interval, timeout time.Duration) error {
+	if s == nil {
+		return errors.New("Server.SetHeartbeat: s is nil")
+	}
+	if interval <= 0 || timeout <= interval {
+		return fmt.Errorf("Server.SetHeartbeat: invalid interval[%v] or timeout[%v]", interval, timeout)
+	}
+	s.heartbeat, s.idleTimeout = interval, timeout
+	return nil
+}
+
+//SetShutdownGrace 设置Shutdown时通知客户端后等待的时间，期间照常收发消息，须在Start之前调用
+func (s *Server) SetShutdownGrace(grace time.Duration) error {
+	if s == nil {
+		return errors.New("Server.SetShutdownGrace: s is nil")
+	}
+	if grace < 0 {
+		return fmt.Errorf("Server.SetShutdownGrace: invalid grace[%v]", grace)
+	}
+	s.shutdownGrace = grace
+	return nil
+}
+
+//Addr 实际监听的地址，Start或UseListener之前为nil
+func (s *Server) Addr() net.Addr {
+	if s == nil || s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+func (s *Server) Start() error {
+	if s == nil {
+		return errors.New("Server.Start: s is nil")
+	}
+	if s.ln == nil {
+		network, address, err := util.ParseAddr(s.addr)
+		if err != nil {
+			return err
+		}
+		if s.ln, err = net.Listen(network, address); err != nil {
+			return err
+		}
+	}
+	if s.tlsConfig != nil {
+		s.ln = tls.NewListener(s.ln, s.tlsConfig)
+	}
 
 	s.stopper2.N.Add(1)
 	go s.broadcast(s.stopper2) //第二阶段才终止
@@ -69,7 +365,12 @@ func (s *Server) Start() error {
 			default:
 				conn, err := s.ln.Accept()
 				if err != nil {
-					s.logger.Printf("Accept error:%v", err)
+					select {
+					case <-s.closing:
+					default:
+						s.logger.Printf("Accept error:%v", err)
+						s.serveErr <- err
+					}
 					return
 				}
 				stopper.N.Add(1)
@@ -81,44 +382,435 @@ func (s *Server) Start() error {
 	return nil
 }
 
+//Serve 启动服务器并阻塞，直到ctx结束、Shutdown被调用或Accept失败
+//ctx结束或Accept失败时最多等待shutdownGrace加defaultShutdownTimeout优雅关闭
+//Shutdown被调用时返回nil，否则返回Accept或关闭的错误
+func (s *Server) Serve(ctx context.Context) error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	return s.Wait(ctx)
+}
+
+//Wait 阻塞直到ctx结束、Shutdown被调用或Accept失败，之后与Serve相同，须在Start之后调用
+func (s *Server) Wait(ctx context.Context) error {
+	if s == nil {
+		return errors.New("Server.Wait: s is nil")
+	}
+	var err error
+	select {
+	case <-s.closing:
+		return nil
+	case <-ctx.Done():
+	case err = <-s.serveErr:
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownGrace+defaultShutdownTimeout)
+	defer cancel()
+	if serr := s.Shutdown(shutdownCtx); err == nil {
+		err = serr
+	}
+	return err
+}
+
+//UseTLS 启用TLS，须在Start之前调用
+//证书文件不存在时生成自签名证书，返回证书指纹供客户端固定
+func (s *Server) UseTLS(certFile, keyFile string) (string, error) {
+	if s == nil {
+		return "", errors.New("Server.UseTLS: s is nil")
+	}
+	cert, err := util.LoadOrCreateCert(certFile, keyFile)
+	if err != nil {
+		return "", err
+	}
+	s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	return util.Fingerprint(cert.Certificate[0]), nil
+}
+
 func (s *Server) broadcast(parentStop *util.Stopper) {
 	defer parentStop.N.Done()
-	clients := make(map[client]*util.Stopper)
+	clients := make(map[client]int) //值为连续丢弃的帧数
+	sessions := make(map[client]*session)
+	members := make(map[client]*proto.Member) //不含Idle和Rooms，查询时计算
+	active := make(map[client]time.Time)      //最后一次发言的时间
+	muted := make(map[string]bool)            //禁言的昵称或IP，与封禁一样不随连接结束
+
+	rooms := make(map[string]map[client]bool)
+	byNick := make(map[string]client)
+	opTokens := make(map[string]bool) //被授予管理员的会话token，与昵称无关
+	var announce *proto.Frame         //最后一次通知，握手后还未进入的客户端进入时补发
+
+	kick := func(cli client, reason string) {
+		sess := sessions[cli]
+		if sess == nil {
+			return
+		}
+		select {
+		case <-sess.kicked:
+		default:
+			sess.reason = reason
+			close(sess.kicked)
+		}
+	}
+	isOp := func(cli client) bool {
+		sess := sessions[cli]
+		if sess == nil {
+			return false
+		}
+		return (len(sess.account) > 0 && s.ops[sess.account]) || (len(sess.token) > 0 && opTokens[sess.token])
+	}
+	isMuted := func(cli client) bool {
+		if m := members[cli]; m != nil && muted[m.Nick] {
+			return true
+		}
+		sess := sessions[cli]
+		if sess == nil || sess.conn == nil {
+			return false
+		}
+		host := hostOf(sess.conn)
+		return len(host) > 0 && muted[host]
+	}
+	send := func(cli client, f *proto.Frame) {
+		select {
+		case cli <- f:
+			if clients[cli] > 0 {
+				clients[cli] = 0
+			}
+			return
+		default:
+		}
+		//通道已满
+		switch s.slow.Policy {
+		case DropOldest:
+			select {
+			case <-cli:
+			default:
+			}
+			select {
+			case cli <- f:
+			default:
+			}
+		case DropNewest:
+		case Disconnect:
+			if _, ok := clients[cli]; !ok {
+				break
+			}
+			if clients[cli]++; clients[cli] > s.slow.Threshold {
+				kick(cli, "too slow")
+			}
+		case Block:
+			timer := time.NewTimer(s.slow.Timeout)
+			defer timer.Stop()
+			select {
+			case cli <- f:
+			case <-timer.C:
+				kick(cli, "too slow")
+			}
+		}
+	}
+	sendRoom := func(f *proto.Frame) {
+		for cli := range rooms[f.Room] {
+			send(cli, f)
+		}
+	}
+	save := func(f *proto.Frame) {
+		if err := s.history.Append(f); err != nil {
+			s.logger.Printf("history append error:%v", err)
+		}
+	}
+	replay := func(cli client, n int, since uint64, match func(*proto.Frame) bool) {
+		var fs []*proto.Frame
+		var err error
+		if since > 0 {
+			fs, err = s.history.Since(since, match)
+			if len(fs) > n {
+				fs = fs[len(fs)-n:]
+			}
+		} else {
+			fs, err = s.history.Last(n, match)
+		}
+		if err != nil {
+			s.logger.Printf("history error:%v", err)
+			return
+		}
+		for _, f := range fs {
+			send(cli, f)
+		}
+	}
+	//lastID 存储中最后一条消息的ID，重连的客户端不应收到过比它大的ID
+	lastID := func() uint64 {
+		fs, err := s.history.Last(1, nil)
+		if err != nil || len(fs) == 0 {
+			return 0
+		}
+		return fs[0].ID
+	}
+	join := func(cli client, room string) bool {
+		if rooms[room][cli] {
+			return false
+		}
+		if rooms[room] == nil {
+			rooms[room] = make(map[client]bool)
+		}
+		rooms[room][cli] = true
+		return true
+	}
+	part := func(cli client, room string) bool {
+		if !rooms[room][cli] {
+			return false
+		}
+		delete(rooms[room], cli)
+		if len(rooms[room]) == 0 {
+			delete(rooms, room)
+		}
+		return true
+	}
+
+	//member 成员当前的状态
+	member := func(cli client, now time.Time) proto.Member {
+		m := *members[cli]
+		m.Idle = now.Sub(active[cli])
+		m.Queue = len(cli)
+		for room, in := range rooms {
+			if in[cli] {
+				m.Rooms = append(m.Rooms, room)
+			}
+		}
+		sort.Strings(m.Rooms)
+		return m
+	}
+	//presence 通知除cli以外的所有成员
+	presence := func(cli client, from, text string) {
+		f := proto.New(proto.TypePresence, from, "", text)
+		if text != proto.PresenceOffline {
+			f.Members = []proto.Member{member(cli, f.Time)}
+		}
+		for other := range clients {
+			if other != cli {
+				send(other, f)
+			}
+		}
+	}
 	for {
 		select {
-		case cli := <-s.entering:
-			clients[cli] = nil
 		case msg := <-s.messages:
-			for cli, st := range clients {
-				select {
-				case cli <- msg:
-					//do nothing
-				default:
-					//阻塞则走异步
-					if st == nil {
-						st = util.NewStopper()
-						clients[cli] = st
+			if _, ok := clients[msg.cli]; !ok && msg.kind != msgEnter && msg.kind != msgAnnounce {
+				//已离开的客户端
+				continue
+			}
+			switch msg.kind {
+			case msgEnter:
+				clients[msg.cli] = 0
+				sessions[msg.cli] = msg.sess
+				byNick[msg.name] = msg.cli
+				if sess := msg.sess; sess != nil && s.ops[msg.name] && sess.account != msg.name && len(sess.token) > 0 {
+					//未登录的昵称只凭名字不能识别，授予第一个进入的会话
+					delete(s.ops, msg.name)
+					opTokens[sess.token] = true
+				}
+				now := time.Now()
+				members[msg.cli] = &proto.Member{Nick: msg.name, Since: now}
+				if msg.sess != nil && msg.sess.conn != nil {
+					members[msg.cli].Addr = msg.sess.conn.RemoteAddr().String()
+				}
+				active[msg.cli] = now
+				joined := []string{msg.room}
+				join(msg.cli, msg.room)
+				for _, room := range msg.rooms {
+					if join(msg.cli, room) {
+						joined = append(joined, room)
+					}
+				}
+				roster := proto.New(proto.TypePresence, msg.name, "", proto.PresenceRoster)
+				for cli := range members {
+					roster.Members = append(roster.Members, member(cli, now))
+				}
+				sort.Slice(roster.Members, func(i, j int) bool { return roster.Members[i].Nick < roster.Members[j].Nick })
+				send(msg.cli, roster)
+				presence(msg.cli, msg.name, proto.PresenceOnline)
+				//只凭昵称不能证明身份，私聊只回放给登录的账户或接管了旧连接的会话
+				direct := msg.sess != nil && (msg.sess.account == msg.name || msg.sess.old != nil)
+				if msg.since > 0 && msg.since <= lastID() {
+					//断线重连，补发期间错过的消息
+					replay(msg.cli, maxHistory, msg.since, entryMatch(joined, msg.name, direct))
+				} else {
+					replay(msg.cli, s.replay, 0, entryMatch(joined, msg.name, direct))
+				}
+				for _, room := range joined {
+					sendRoom(proto.New(proto.TypeJoin, msg.name, room, ""))
+				}
+				if announce != nil {
+					send(msg.cli, announce)
+				}
+				if isMuted(msg.cli) {
+					send(msg.cli, proto.New(proto.TypeNotice, "", "", "you are muted"))
+				}
+			case msgJoin:
+				if join(msg.cli, msg.room) {
+					replay(msg.cli, s.replay, 0, roomMatch(msg.room))
+					sendRoom(proto.New(proto.TypeJoin, msg.name, msg.room, ""))
+					presence(msg.cli, msg.name, proto.PresenceUpdate)
+				}
+			case msgHistory:
+				replay(msg.cli, msg.count, 0, roomMatch(msg.room))
+			case msgPart:
+				if part(msg.cli, msg.room) {
+					f := proto.New(proto.TypePart, msg.name, msg.room, "")
+					send(msg.cli, f)
+					sendRoom(f)
+					presence(msg.cli, msg.name, proto.PresenceUpdate)
+				}
+			case msgText:
+				if !rooms[msg.room][msg.cli] {
+					send(msg.cli, proto.New(proto.TypeError, "", msg.room, "you are not in this room"))
+					break
+				}
+				if isMuted(msg.cli) {
+					send(msg.cli, proto.New(proto.TypeError, "", msg.room, "you are muted"))
+					break
+				}
+				active[msg.cli] = time.Now()
+				f := proto.New(proto.TypeMsg, msg.name, msg.room, msg.text)
+				save(f)
+				sendRoom(f)
+			case msgReply:
+				send(msg.cli, msg.frame)
+			case msgDirect:
+				if isMuted(msg.cli) {
+					send(msg.cli, proto.New(proto.TypeError, "", "", "you are muted"))
+					break
+				}
+				to, ok := byNick[msg.to]
+				if !ok {
+					send(msg.cli, proto.New(proto.TypeError, "", "", "nick["+msg.to+"] is not connected"))
+					break
+				}
+				active[msg.cli] = time.Now()
+				f := proto.New(proto.TypeDirect, msg.name, "", msg.text)
+				f.To = msg.to
+				save(f)
+				send(to, f)
+				if to != msg.cli {
+					send(msg.cli, f)
+				}
+			case msgNick:
+				if byNick[msg.text] == msg.cli {
+					delete(byNick, msg.text)
+				}
+				byNick[msg.name] = msg.cli
+				if muted[msg.text] {
+					//改名不能解除禁言
+					muted[msg.name] = true
+				}
+				//同在多个房间的成员只通知一次
+				f := proto.New(proto.TypeNick, msg.text, "", msg.name)
+				notified := map[client]bool{msg.cli: true}
+				send(msg.cli, f)
+				for _, in := range rooms {
+					if !in[msg.cli] {
+						continue
+					}
+					for cli := range in {
+						if !notified[cli] {
+							notified[cli] = true
+							send(cli, f)
+						}
+					}
+				}
+				members[msg.cli].Nick = msg.name
+				presence(msg.cli, msg.text, proto.PresenceUpdate)
+			case msgFlood:
+				send(msg.cli, proto.New(proto.TypeNotice, "", "", "you are kicked for flooding"))
+				kick(msg.cli, "flooding")
+			case msgAnnounce:
+				announce = proto.New(proto.TypeNotice, "", "", msg.text)
+				for cli := range clients {
+					send(cli, announce)
+				}
+			case msgWho:
+				f := proto.New(proto.TypeWho, "", msg.room, "")
+				for cli := range members {
+					if len(msg.room) == 0 || rooms[msg.room][cli] {
+						f.Members = append(f.Members, member(cli, f.Time))
+					}
+				}
+				sort.Slice(f.Members, func(i, j int) bool { return f.Members[i].Nick < f.Members[j].Nick })
+				send(msg.cli, f)
+			case msgMod:
+				f := msg.frame
+				if !isOp(msg.cli) {
+					send(msg.cli, proto.New(proto.TypeError, "", "", "you are not an operator"))
+					break
+				}
+				target, online := byNick[f.To]
+				var err error
+				switch f.Type {
+				case proto.TypeKick, proto.TypeOp:
+					if !online || sessions[target] == nil {
+						err = errors.New("nick[" + f.To + "] is not connected")
+					} else if f.Type == proto.TypeOp && isOp(target) {
+						err = errors.New("[" + f.To + "] is already an operator")
+					}
+				case proto.TypeBan, proto.TypeUnban:
+					var changed bool
+					if changed, err = s.bans.update(f.To, f.Type == proto.TypeBan); err == nil && !changed {
+						err = errors.New("[" + f.To + "] is already " + string(f.Type) + "ned")
+					}
+				case proto.TypeMute, proto.TypeUnmute:
+					if muted[f.To] == (f.Type == proto.TypeMute) {
+						err = errors.New("[" + f.To + "] is already " + string(f.Type) + "d")
 					}
-					st.N.Add(1)
-					go func(cli client, msg string, st *util.Stopper) {
-						defer st.N.Done()
-						select {
-						case cli <- msg:
-							//do nothing
-						case <-st.StopCh:
-							return
+				}
+				if err != nil {
+					send(msg.cli, proto.New(proto.TypeError, "", "", err.Error()))
+					break
+				}
+				//通知所有人后再踢出，被踢出者也能收到
+				for cli := range clients {
+					send(cli, f)
+				}
+				switch f.Type {
+				case proto.TypeKick:
+					kick(target, "kicked")
+				case proto.TypeBan:
+					for cli, sess := range sessions {
+						if cli == target || (sess != nil && hostOf(sess.conn) == f.To) {
+							kick(cli, "banned")
 						}
-					}(cli, msg, st)
+					}
+				case proto.TypeMute:
+					muted[f.To] = true
+				case proto.TypeUnmute:
+					delete(muted, f.To)
+				case proto.TypeOp:
+					//登录的账户长期有效，匿名的只属于当前会话
+					if sess := sessions[target]; len(sess.account) > 0 {
+						s.ops[sess.account] = true
+					} else {
+						opTokens[sess.token] = true
+					}
 				}
+			case msgLeave:
+				var left []string
+				for room := range rooms {
+					if part(msg.cli, room) {
+						left = append(left, room)
+					}
+				}
+				delete(clients, msg.cli)
+				delete(sessions, msg.cli)
+				delete(members, msg.cli)
+				delete(active, msg.cli)
+				if byNick[msg.name] == msg.cli {
+					delete(byNick, msg.name)
+				}
+				close(msg.cli)
+				for _, room := range left {
+					sendRoom(proto.New(proto.TypePart, msg.name, room, msg.text))
+				}
+				presence(msg.cli, msg.name, proto.PresenceOffline)
 			}
-		case cli := <-s.leaving:
-			//优雅结束
-			clients[cli].Stop()
-			delete(clients, cli)
-			close(cli)
 		case <-parentStop.StopCh:
-			for cli, st := range clients {
-				st.Stop()
+			for cli := range clients {
 				delete(clients, cli)
 				close(cli)
 			}
@@ -127,69 +819,526 @@ func (s *Server) broadcast(parentStop *util.Stopper) {
 	}
 }
 
+//roomMatch 房间内的聊天消息
+func roomMatch(room string) func(*proto.Frame) bool {
+	return func(f *proto.Frame) bool {
+		return f.Type == proto.TypeMsg && f.Room == room
+	}
+}
+
+//entryMatch 进入服务器时回放所在房间的消息，direct为true时包括与该昵称有关的私聊
+func entryMatch(rooms []string, nick string, direct bool) func(*proto.Frame) bool {
+	return func(f *proto.Frame) bool {
+		if f.Type == proto.TypeDirect {
+			return direct && (f.From == nick || f.To == nick)
+		}
+		if f.Type != proto.TypeMsg {
+			return false
+		}
+		for _, room := range rooms {
+			if f.Room == room {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func validNick(nick string) error {
+	if len(nick) == 0 || len(nick) > maxNickLen {
+		return fmt.Errorf("nick length should be in [1, %d]", maxNickLen)
+	}
+	if strings.ContainsAny(nick, "[]#/ \t\r\n") {
+		return fmt.Errorf("nick[%s] contains invalid characters", nick)
+	}
+	if net.ParseIP(nick) != nil {
+		//与IP的封禁和禁言冲突
+		return fmt.Errorf("nick[%s] should not be an ip", nick)
+	}
+	return nil
+}
+
+func validRoom(room string) error {
+	if len(room) == 0 || len(room) > maxRoomLen {
+		return fmt.Errorf("room length should be in [1, %d]", maxRoomLen)
+	}
+	if strings.ContainsAny(room, "#/ \t\r\n") {
+		return fmt.Errorf("room[%s] contains invalid characters", room)
+	}
+	return nil
+}
+
+//claimNick 占用昵称，重复则返回错误
+//被同一token的旧连接占用时，关闭旧连接并由sess接管
+func (s *Server) claimNick(nick string, sess *session) error {
+	if err := validNick(nick); err != nil {
+		return err
+	}
+	s.nickMu.Lock()
+	defer s.nickMu.Unlock()
+	old := s.nicks[nick]
+	if old != nil {
+		if old == sess || len(sess.token) == 0 || old.token != sess.token {
+			return fmt.Errorf("nick[%s] is already in use", nick)
+		}
+	} else if s.maxClients > 0 && len(sess.nick) == 0 && len(s.nicks) >= s.maxClients {
+		//改名不算新增
+		return errors.New("server is full")
+	}
+	if old != nil {
+		sess.old = old
+		if old.conn != nil {
+			old.conn.Close()
+		}
+	}
+	s.nicks[nick] = sess
+	sess.nick = nick
+	return nil
+}
+
+//nickAllowed 启用账户后，不允许匿名时不能改名，允许匿名时不能改为已注册的昵称
+func (s *Server) nickAllowed(nick string) error {
+	if s.users == nil {
+		return nil
+	}
+	if !s.anonymous {
+		return errors.New("nick can not be changed when login is required")
+	}
+	if s.users.Exists(nick) {
+		return fmt.Errorf("nick[%s] is registered", nick)
+	}
+	return nil
+}
+
+//releaseNick 释放昵称，已被其他会话接管时不做处理
+func (s *Server) releaseNick(nick string, sess *session) {
+	s.nickMu.Lock()
+	defer s.nickMu.Unlock()
+	if s.nicks[nick] == sess {
+		delete(s.nicks, nick)
+	}
+	if sess.nick == nick {
+		sess.nick = ""
+	}
+}
+
+func newToken() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+//handshake 连接的第一帧须为hello，需要登录时先回复auth并校验，再回复welcome或error
+func (s *Server) handshake(conn net.Conn, reader *proto.Reader) (*proto.Frame, *session, error) {
+	f, err := reader.Read()
+	sess := &session{conn: conn, kicked: make(chan struct{}), left: make(chan struct{})}
+	if err == nil {
+		if f.Type != proto.TypeHello {
+			err = errors.New("hello is required")
+		} else if err = validNick(f.From); err == nil {
+			if s.bans.banned(f.From, hostOf(conn)) {
+				err = errors.New("you are banned from this server")
+			} else if logged, e := s.login(conn, reader, f.From); e != nil {
+				err = e
+			} else if logged {
+				sess.account = f.From
+			}
+		}
+	}
+	if err == nil {
+		sess.token = f.Text
+		if len(sess.token) == 0 {
+			sess.token = newToken()
+		}
+		err = s.claimNick(f.From, sess)
+	}
+	if err != nil {
+		proto.Write(conn, proto.New(proto.TypeError, "", "", err.Error()))
+		return nil, nil, err
+	}
+	welcome := proto.New(proto.TypeWelcome, f.From, "", sess.token)
+	welcome.Count = s.maxMessage
+	welcome.Epoch = s.epoch
+	if err := proto.Write(conn, welcome); err != nil {
+		s.releaseNick(f.From, sess)
+		close(sess.left)
+		return nil, nil, err
+	}
+	return f, sess, nil
+}
+
+//login 已注册的昵称或不允许匿名时，要求客户端发送密码或令牌，登录成功时返回true
+func (s *Server) login(conn net.Conn, reader *proto.Reader, nick string) (bool, error) {
+	if s.users == nil || (s.anonymous && !s.users.Exists(nick)) {
+		return false, nil
+	}
+	key := hostOf(conn)
+	if len(key) == 0 {
+		//Unix套接字等没有IP的连接按昵称计算
+		key = nick
+	}
+	if !s.logins.allow(key, time.Now()) {
+		return false, errors.New("too many failed logins, try again later")
+	}
+	if err := proto.Write(conn, proto.New(proto.TypeAuth, nick, "", "")); err != nil {
+		return false, err
+	}
+	f, err := reader.Read()
+	if err != nil {
+		return false, err
+	}
+	if f.Type != proto.TypeAuth {
+		return false, errors.New("login is required")
+	}
+	if err := s.users.Verify(nick, f.Text); err != nil {
+		s.logger.Printf("[%s] login %s failed:%v", conn.RemoteAddr(), nick, err)
+		s.logins.fail(key, time.Now())
+		return false, errLogin
+	}
+	s.logins.succeed(key)
+	return true, nil
+}
+
 //goroutine
 func (s *Server) handleConn(conn net.Conn, parentStop *util.Stopper) {
 	defer parentStop.N.Done()
 
-	ch := make(chan string, capClient)
-	s.entering <- ch
-	name := conn.RemoteAddr().String()
+	//握手期间也要响应结束
+	handshakeDone := make(chan struct{})
+	go func() {
+		select {
+		case <-parentStop.StopCh:
+			conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(s.handshakeTimeout))
+	reader := proto.NewReader(conn)
+	hello, sess, err := s.handshake(conn, reader)
+	close(handshakeDone)
+	if err != nil {
+		s.logger.Printf("[%s] handshake error:%v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	defer close(sess.left)
+	name := hello.From
+	if sess.old != nil && sess.old.left != nil {
+		//接管时旧连接的离开须在进入之前，否则其他人看到的是进入、进入、离开
+		select {
+		case <-sess.old.left:
+		case <-parentStop.StopCh:
+			conn.Close()
+			s.releaseNick(name, sess)
+			return
+		}
+	}
+
+	ch := make(chan *proto.Frame, s.clientCap)
 	//notification
-	s.messages <- "[" + name + "]" + " is entering."
+	enter := message{kind: msgEnter, cli: ch, name: name, room: DefaultRoom, sess: sess}
+	if hello.Epoch == s.epoch {
+		//其他实例的ID与这里的无关
+		enter.since = hello.ID
+	}
+	for _, room := range hello.Rooms {
+		if validRoom(room) == nil {
+			enter.rooms = append(enter.rooms, room)
+		}
+	}
+	s.messages <- enter
 
 	writerStop := make(chan struct{})
+	var timedOut bool //读取超时，writerStop关闭前设置
+
+	limit := newLimiter(s.rate)
+	var flooded bool //已被踢出，不再处理之后的帧
 
 	//read
 	var n sync.WaitGroup
-	defer n.Wait()
-	defer conn.Close() //when func returns, it should invoke first
-
 	n.Add(1)
 	go func() {
 		defer n.Done()
-		scanner := bufio.NewScanner(conn)
 		for {
 			select {
 			case <-parentStop.StopCh:
 				return
 			default:
-				if !scanner.Scan() {
-					s.logger.Printf("read error:%v", scanner.Err())
+				conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+				f, err := reader.Read()
+				tooLarge := err == proto.ErrTooLarge
+				if err != nil && !tooLarge {
+					var ne net.Error
+					if errors.As(err, &ne) && ne.Timeout() {
+						timedOut = true
+					} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+						//写入结束时关闭连接不算错误
+						s.logger.Printf("read error:%v", err)
+					}
 					close(writerStop)
 					return
 				}
-				s.messages <- "[" + name + "]: " + scanner.Text()
+				if flooded {
+					continue
+				}
+				//按整帧计算，包括昵称、房间等所有字段
+				action, wait := limit.take(reader.Size(), tooLarge)
+				switch action {
+				case limitKick:
+					flooded = true
+					s.messages <- message{kind: msgFlood, cli: ch, name: name}
+					continue
+				case limitWarn:
+					s.messages <- message{kind: msgReply, cli: ch,
+						frame: proto.New(proto.TypeNotice, "", "", "you are sending too fast, slow down")}
+				}
+				if wait > 0 {
+					//限速：暂停读取，TCP缓冲满后发送方也会被阻塞
+					select {
+					case <-time.After(wait):
+					case <-parentStop.StopCh:
+						return
+					}
+				}
+				if tooLarge {
+					s.messages <- message{kind: msgReply, cli: ch,
+						frame: proto.New(proto.TypeError, "", "", err.Error())}
+					continue
+				}
+				if f.Type == proto.TypePong {
+					//只用于刷新读取超时
+					continue
+				}
+				s.messages <- s.dispatch(f, ch, sess, &name)
 			}
 		}
 	}()
 
+	//drain 在deadline之前尽量送达已排队的帧
+	drain := func(deadline time.Time) {
+		conn.SetWriteDeadline(deadline)
+		for len(ch) > 0 {
+			if f, ok := <-ch; !ok || proto.Write(conn, f) != nil {
+				break
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(s.heartbeat)
+	defer heartbeat.Stop()
+	leave := message{kind: msgLeave, cli: ch}
 loop:
 	for { //write
 		select {
-		case msg := <-ch:
-			if _, err := conn.Write([]byte(msg + "\n")); err != nil {
+		case f, ok := <-ch:
+			if !ok {
+				leave.text = "server shutting down"
+				break loop
+			}
+			if err := proto.Write(conn, f); err != nil {
 				//写不成功，认为已经离开
 				s.logger.Printf("write error:%v", err)
-				s.messages <- "[" + name + "]" + " has left."
 				break loop
 			}
 		case <-parentStop.StopCh:
-			s.messages <- "[" + name + "]" + " is leaving."
+			leave.text = "server shutting down"
+			deadline := s.drainDeadline()
+			drain(deadline)
+			//close之后客户端不再重连
+			conn.SetWriteDeadline(deadline)
+			proto.Write(conn, proto.New(proto.TypeClose, "", "", leave.text))
 			break loop
+		case <-heartbeat.C:
+			if err := proto.Write(conn, proto.New(proto.TypePing, "", "", "")); err != nil {
+				s.logger.Printf("write error:%v", err)
+				break loop
+			}
 		case <-writerStop:
-			s.messages <- "[" + name + "]" + " has left."
+			if timedOut {
+				leave.text = "timed out"
+			}
+			break loop
+		case <-sess.kicked:
+			//包括踢出通知
+			deadline := time.Now().Add(s.handshakeTimeout)
+			drain(deadline)
+			leave.text = sess.reason
+			//close之后客户端不再重连
+			conn.SetWriteDeadline(deadline)
+			proto.Write(conn, proto.New(proto.TypeClose, "", "", leave.text))
 			break loop
 		}
 	}
-	s.leaving <- ch
+	conn.Close() //结束读取
+	n.Wait()     //读取结束后昵称不再变化
+	leave.name = name
+	s.messages <- leave
+	s.releaseNick(name, sess) //离开消息入队后才释放，保证同名新连接的进入在其后
 }
 
+//dispatch 将客户端发来的帧转换为消息，name为当前昵称，改名时更新
+func (s *Server) dispatch(f *proto.Frame, ch client, sess *session, name *string) message {
+	msg := message{cli: ch, name: *name, room: f.Room, text: f.Text}
+	if len(msg.room) == 0 {
+		msg.room = DefaultRoom
+	}
+	reply := func(t proto.Type, text string) message {
+		return message{kind: msgReply, cli: ch, frame: proto.New(t, "", f.Room, text)}
+	}
+	if (f.Type == proto.TypeMsg || f.Type == proto.TypeDirect) && len(f.Text) > s.maxMessage {
+		return reply(proto.TypeError, fmt.Sprintf("message is too large (%d > %d bytes)", len(f.Text), s.maxMessage))
+	}
+	switch f.Type {
+	case proto.TypeMsg:
+		msg.kind = msgText
+	case proto.TypeDirect:
+		if err := validNick(f.To); err != nil {
+			return reply(proto.TypeError, err.Error())
+		}
+		msg.kind = msgDirect
+		msg.to = f.To
+	case proto.TypeJoin, proto.TypePart:
+		if err := validRoom(msg.room); err != nil {
+			return reply(proto.TypeError, err.Error())
+		}
+		msg.kind = msgJoin
+		if f.Type == proto.TypePart {
+			msg.kind = msgPart
+		}
+	case proto.TypeNick:
+		if err := s.nickAllowed(f.Text); err != nil {
+			return reply(proto.TypeError, err.Error())
+		}
+		//封禁的昵称不能改名得到
+		if s.bans.banned(f.Text, "") {
+			return reply(proto.TypeError, "nick["+f.Text+"] is banned")
+		}
+		if err := s.claimNick(f.Text, sess); err != nil {
+			return reply(proto.TypeError, err.Error())
+		}
+		s.releaseNick(*name, sess)
+		msg.kind = msgNick
+		msg.text = *name
+		*name, msg.name = f.Text, f.Text
+	case proto.TypeKick, proto.TypeBan, proto.TypeUnban, proto.TypeMute, proto.TypeUnmute, proto.TypeOp:
+		err := validNick(f.To)
+		if f.Type != proto.TypeKick && f.Type != proto.TypeOp && net.ParseIP(f.To) != nil {
+			err = nil
+		}
+		if err != nil {
+			return reply(proto.TypeError, err.Error())
+		}
+		msg.kind = msgMod
+		msg.frame = proto.New(f.Type, *name, "", f.Text)
+		msg.frame.To = f.To
+	case proto.TypePing:
+		return reply(proto.TypePong, f.Text)
+	case proto.TypeWho:
+		msg.kind = msgWho
+		msg.room = f.Room
+		if len(msg.room) > 0 {
+			if err := validRoom(msg.room); err != nil {
+				return reply(proto.TypeError, err.Error())
+			}
+		}
+	case proto.TypeHistory:
+		msg.kind = msgHistory
+		msg.count = f.Count
+		if msg.count <= 0 || msg.count > maxHistory {
+			msg.count = maxHistory
+		}
+	default:
+		return reply(proto.TypeError, fmt.Sprintf("unsupported frame type[%s]", f.Type))
+	}
+	return msg
+}
+
+//ShutDown 同Shutdown，最多等待shutdownGrace加defaultShutdownTimeout
 func (s *Server) ShutDown() {
-	if s == nil || s.ln == nil {
+	if s == nil {
 		return
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownGrace+defaultShutdownTimeout)
+	defer cancel()
+	s.Shutdown(ctx)
+}
+
+//Shutdown 通知所有客户端，等待shutdownGrace后停止接受新连接，
+//向客户端发送完已排队的帧和close帧后断开，未Start（或Start失败）时只关闭消息存储
+//ctx结束时强制关闭剩余的连接并返回ctx.Err()，只有第一次调用有效
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	if s.ln == nil {
+		s.closeOnce.Do(func() {
+			s.history.Close()
+		})
+		return nil
+	}
+	err := errors.New("Server.Shutdown: already shut down")
+	s.closeOnce.Do(func() {
+		err = s.shutdown(ctx)
+	})
+	return err
+}
+
+func (s *Server) shutdown(ctx context.Context) error {
+	text := "server shutting down"
+	if s.shutdownGrace > 0 {
+		secs := (s.shutdownGrace + time.Second - 1) / time.Second
+		text = fmt.Sprintf("server shutting down in %d seconds", secs)
+	}
+	s.messages <- message{kind: msgAnnounce, text: text}
+	if s.shutdownGrace > 0 {
+		select {
+		case <-time.After(s.shutdownGrace):
+		case <-ctx.Done():
+		}
+	}
+
+	drainBy := time.Now().Add(s.handshakeTimeout)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(drainBy) {
+		drainBy = deadline
+	}
+	s.drainBy.Store(drainBy.UnixNano())
+	close(s.closing)
 	s.ln.Close()
-	s.stopper1.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		s.stopper1.Stop()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.closeConns()
+		<-done
+	}
 	//broadcast最后关闭
 	s.stopper2.Stop()
+	s.history.Close()
+	return err
+}
+
+//drainDeadline 断开前发送已排队帧的截止时间
+func (s *Server) drainDeadline() time.Time {
+	if n := s.drainBy.Load(); n > 0 {
+		return time.Unix(0, n)
+	}
+	return time.Now().Add(s.handshakeTimeout)
+}
+
+//closeConns 强制关闭所有已握手的连接，使阻塞的写入返回
+func (s *Server) closeConns() {
+	s.nickMu.Lock()
+	defer s.nickMu.Unlock()
+	for _, sess := range s.nicks {
+		if sess.conn != nil {
+			sess.conn.Close()
+		}
+	}
 }
@@ -1,20 +1,42 @@
 package server
 
 import (
-	"bufio"
-	"fmt"
+	"context"
+	"crypto/tls"
+	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/liuc2050/easychat/auth"
+	chatclient "github.com/liuc2050/easychat/client"
+	"github.com/liuc2050/easychat/history"
+	"github.com/liuc2050/easychat/memnet"
+	"github.com/liuc2050/easychat/proto"
+	"github.com/liuc2050/easychat/util"
 )
 
 var std = log.New(os.Stderr, "", log.LstdFlags)
 
+//listen 让srv在内存连接上接受连接，返回拨号函数
+func listen(t *testing.T, srv *Server) func() net.Conn {
+	ln := memnet.Listen(t.Name())
+	srv.UseListener(ln)
+	return func() net.Conn {
+		conn, err := ln.Dial("", "")
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		return conn
+	}
+}
+
 func TestStart(t *testing.T) {
-	srv := New("4321", std)
+	srv := New("0", std)
 	if err := srv.Start(); err != nil {
 		t.Fatalf("start failed:%v", err)
 	}
@@ -35,158 +57,1014 @@ func TestStart(t *testing.T) {
 }
 
 func TestBroadcast(t *testing.T) {
-	srv := New("3829", std)
+	srv := New("0", std)
 	srv.stopper1.N.Add(1)
 	go srv.broadcast(srv.stopper1)
-	cli1 := make(chan string)
-	cli2 := make(chan string)
-	srv.entering <- cli1
-	srv.entering <- cli2
-	srv.messages <- "cli entered"
-	select {
-	case msg := <-cli1:
-		if msg != "cli entered" {
-			t.Fatalf("cli should receive message")
-		}
-	case msg := <-cli2:
-		if msg != "cli entered" {
-			t.Fatalf("cli should receive message")
-		}
+	cli1 := make(chan *proto.Frame, capClient)
+	cli2 := make(chan *proto.Frame, capClient)
+	srv.messages <- message{kind: msgEnter, cli: cli1, name: "cli1", room: DefaultRoom}
+	srv.messages <- message{kind: msgEnter, cli: cli2, name: "cli2", room: DefaultRoom}
+	expect(t, cli1, "#lobby [cli1] is entering.")
+	expect(t, cli1, "#lobby [cli2] is entering.")
+	expect(t, cli2, "#lobby [cli2] is entering.")
+
+	srv.messages <- message{kind: msgJoin, cli: cli2, name: "cli2", room: "go"}
+	expect(t, cli2, "#go [cli2] is entering.")
+	srv.messages <- message{kind: msgText, cli: cli2, name: "cli2", room: "go", text: "only go"}
+	expect(t, cli2, "#go [cli2]: only go")
+	srv.messages <- message{kind: msgText, cli: cli1, name: "cli1", room: "go", text: "not member"}
+	expect(t, cli1, "#go error: you are not in this room")
+	srv.messages <- message{kind: msgText, cli: cli1, name: "cli1", room: DefaultRoom, text: "cli entered"}
+	expect(t, cli1, "#lobby [cli1]: cli entered")
+	expect(t, cli2, "#lobby [cli1]: cli entered")
+	srv.messages <- message{kind: msgNick, cli: cli1, name: "tom", text: "cli1"}
+	expect(t, cli1, "[cli1] is now known as [tom].")
+	expect(t, cli2, "[cli1] is now known as [tom].")
+	srv.messages <- message{kind: msgDirect, cli: cli2, name: "cli2", to: "tom", text: "secret"}
+	expect(t, cli1, "[cli2] -> [tom]: secret")
+	expect(t, cli2, "[cli2] -> [tom]: secret")
+	srv.messages <- message{kind: msgDirect, cli: cli2, name: "cli2", to: "cli1", text: "gone"}
+	expect(t, cli2, "error: nick[cli1] is not connected")
+
+	srv.messages <- message{kind: msgLeave, cli: cli1, name: "tom"}
+	for range cli1 {
+		//等待cli1关闭
 	}
+	expect(t, cli2, "#lobby [tom] has left.")
 
-	srv.leaving <- cli1
+	srv.messages <- message{kind: msgPart, cli: cli2, name: "cli2", room: "go"}
+	expect(t, cli2, "#go [cli2] has left.")
+	srv.messages <- message{kind: msgText, cli: cli2, name: "cli2", room: "go", text: "gone"}
+	expect(t, cli2, "#go error: you are not in this room")
+
+	srv.stopper1.Stop()
 	select {
-	case _, ok := <-cli1:
+	case _, ok := <-cli2:
 		if ok {
-			t.Fatalf("cli1 should be closed")
+			t.Fatalf("cli2 should be closed")
 		}
 	}
+}
 
-	srv.messages <- "cli left"
+//next 接收下一帧
+func next(t *testing.T, cli <-chan *proto.Frame) *proto.Frame {
+	t.Helper()
 	select {
-	case msg := <-cli2:
-		if msg != "cli left" {
-			t.Fatalf("cli2 should receive message")
+	case f := <-cli:
+		return f
+	case <-time.After(2 * time.Second):
+		t.Fatalf("recv timeout")
+	}
+	return nil
+}
+
+func TestWho(t *testing.T) {
+	srv := New("0", std)
+	srv.stopper1.N.Add(1)
+	go srv.broadcast(srv.stopper1)
+	defer srv.stopper1.Stop()
+	cli1 := make(chan *proto.Frame, capClient)
+	cli2 := make(chan *proto.Frame, capClient)
+	srv.messages <- message{kind: msgEnter, cli: cli1, name: "cli1", room: DefaultRoom}
+	if f := next(t, cli1); f.Type != proto.TypePresence || f.Text != proto.PresenceRoster || len(f.Members) != 1 || f.Members[0].Nick != "cli1" {
+		t.Fatalf("got %#v, want roster of cli1", f)
+	}
+	srv.messages <- message{kind: msgEnter, cli: cli2, name: "cli2", room: DefaultRoom}
+	srv.messages <- message{kind: msgJoin, cli: cli2, name: "cli2", room: "go"}
+	srv.messages <- message{kind: msgNick, cli: cli2, name: "tom", text: "cli2"}
+	srv.messages <- message{kind: msgWho, cli: cli1}
+	srv.messages <- message{kind: msgWho, cli: cli1, room: "go"}
+	var presence []string
+	var who []*proto.Frame
+	for len(who) < 2 {
+		switch f := next(t, cli1); f.Type {
+		case proto.TypePresence:
+			presence = append(presence, f.From+" "+f.Text+" "+f.Members[0].Nick+" "+strings.Join(f.Members[0].Rooms, ","))
+		case proto.TypeWho:
+			who = append(who, f)
 		}
 	}
+	want := []string{"cli2 online cli2 lobby", "cli2 update cli2 go,lobby", "cli2 update tom go,lobby"}
+	if strings.Join(presence, "|") != strings.Join(want, "|") {
+		t.Errorf("presence got %q, want %q", presence, want)
+	}
+	if ms := who[0].Members; len(ms) != 2 || ms[0].Nick != "cli1" || ms[1].Nick != "tom" || ms[0].Since.IsZero() {
+		t.Errorf("who got %#v", ms)
+	}
+	if ms := who[1].Members; who[1].Room != "go" || len(ms) != 1 || ms[0].Nick != "tom" {
+		t.Errorf("who #go got %#v", who[1])
+	}
 
-	srv.stopper1.Stop()
+	srv.messages <- message{kind: msgLeave, cli: cli2, name: "tom"}
+	for {
+		if f := next(t, cli1); f.Type == proto.TypePresence {
+			if f.From != "tom" || f.Text != proto.PresenceOffline {
+				t.Errorf("got %#v, want tom offline", f)
+			}
+			break
+		}
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	if err := New("0", std).SetSlowConsumer(Disconnect, 0, 0); err == nil {
+		t.Errorf("invalid threshold, want error")
+	}
+	if p, err := ParseSlowPolicy("drop-oldest"); err != nil || p != DropOldest {
+		t.Errorf("ParseSlowPolicy got %v %v", p, err)
+	}
+	tests := []struct {
+		policy SlowPolicy
+		want   string //通道中剩下的帧
+		kicked bool
+	}{
+		{DropOldest, "online,", false}, //最后是jerry的presence和join
+		{DropNewest, "roster,", false},
+		{Disconnect, "roster,", true},
+		{Block, "roster,", true},
+	}
+	for _, test := range tests {
+		srv := New("0", std)
+		if err := srv.SetSlowConsumer(test.policy, 2, 10*time.Millisecond); err != nil {
+			t.Fatalf("SetSlowConsumer error:%v", err)
+		}
+		srv.stopper1.N.Add(1)
+		go srv.broadcast(srv.stopper1)
+		cli := make(chan *proto.Frame, 2)
+		sess := &session{kicked: make(chan struct{})}
+		//进入后通道中已有roster和join两帧
+		srv.messages <- message{kind: msgEnter, cli: cli, name: "tom", room: DefaultRoom, sess: sess}
+		for _, text := range []string{"1", "2", "3"} {
+			srv.messages <- message{kind: msgText, cli: cli, name: "tom", room: DefaultRoom, text: text}
+		}
+		//cli2进入后之前的消息都已处理，cli会再收到cli2的presence
+		cli2 := make(chan *proto.Frame, capClient)
+		srv.messages <- message{kind: msgEnter, cli: cli2, name: "jerry", room: DefaultRoom}
+		next(t, cli2)
+		srv.stopper1.Stop()
+		var got []string
+		for f := range cli {
+			got = append(got, f.Text)
+		}
+		if strings.Join(got, ",") != test.want {
+			t.Errorf("%v got %q, want %q", test.policy, got, test.want)
+		}
+		select {
+		case <-sess.kicked:
+			if !test.kicked || sess.reason != "too slow" {
+				t.Errorf("%v kicked %q, want kicked %v", test.policy, sess.reason, test.kicked)
+			}
+		default:
+			if test.kicked {
+				t.Errorf("%v should be kicked", test.policy)
+			}
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	srv := New("0", std)
+	srv.UseHistory(history.NewMemory(10), 2)
+	srv.stopper1.N.Add(1)
+	go srv.broadcast(srv.stopper1)
+	defer srv.stopper1.Stop()
+	cli1 := make(chan *proto.Frame, capClient)
+	cli2 := make(chan *proto.Frame, capClient)
+	srv.messages <- message{kind: msgEnter, cli: cli1, name: "cli1", room: DefaultRoom}
+	expect(t, cli1, "#lobby [cli1] is entering.")
+	srv.messages <- message{kind: msgJoin, cli: cli1, name: "cli1", room: "go"}
+	expect(t, cli1, "#go [cli1] is entering.")
+	for _, text := range []string{"1", "2", "3"} {
+		srv.messages <- message{kind: msgText, cli: cli1, name: "cli1", room: DefaultRoom, text: text}
+		expect(t, cli1, "#lobby [cli1]: "+text)
+		srv.messages <- message{kind: msgText, cli: cli1, name: "cli1", room: "go", text: "go" + text}
+		expect(t, cli1, "#go [cli1]: go"+text)
+	}
+	srv.messages <- message{kind: msgDirect, cli: cli1, name: "cli1", to: "cli1", text: "memo"}
+	expect(t, cli1, "[cli1] -> [cli1]: memo")
+
+	//进入时回放默认房间最近2条，不含他人的私聊
+	srv.messages <- message{kind: msgEnter, cli: cli2, name: "cli2", room: DefaultRoom}
+	expect(t, cli2, "#lobby [cli1]: 2")
+	expect(t, cli2, "#lobby [cli1]: 3")
+	expect(t, cli2, "#lobby [cli2] is entering.")
+	srv.messages <- message{kind: msgJoin, cli: cli2, name: "cli2", room: "go"}
+	expect(t, cli2, "#go [cli1]: go2")
+	expect(t, cli2, "#go [cli1]: go3")
+	expect(t, cli2, "#go [cli2] is entering.")
+	srv.messages <- message{kind: msgHistory, cli: cli2, name: "cli2", room: "go", count: 3}
+	expect(t, cli2, "#go [cli1]: go1")
+	expect(t, cli2, "#go [cli1]: go2")
+	expect(t, cli2, "#go [cli1]: go3")
+
+	//同名的匿名连接看不到私聊，登录的账户可以
+	cli3 := make(chan *proto.Frame, capClient)
+	srv.messages <- message{kind: msgEnter, cli: cli3, name: "cli1", room: DefaultRoom, sess: &session{}}
+	expect(t, cli3, "#lobby [cli1]: 2")
+	expect(t, cli3, "#lobby [cli1]: 3")
+	expect(t, cli3, "#lobby [cli1] is entering.")
+	cli4 := make(chan *proto.Frame, capClient)
+	srv.messages <- message{kind: msgEnter, cli: cli4, name: "cli1", room: DefaultRoom, sess: &session{account: "cli1"}}
+	expect(t, cli4, "#lobby [cli1]: 3")
+	expect(t, cli4, "[cli1] -> [cli1]: memo")
+}
+
+//expect 比较帧去掉时间后的显示文本，跳过成员变化通知
+func expect(t *testing.T, cli <-chan *proto.Frame, want string) {
+	t.Helper()
 	select {
-	case _, ok := <-cli2:
-		if ok {
-			t.Fatalf("cli2 should be closed")
+	case f := <-cli:
+		if f.Type == proto.TypePresence {
+			expect(t, cli, want)
+			return
+		}
+		if got := f.String()[len("15:04:05 "):]; got != want {
+			t.Fatalf("got %q, want %q", got, want)
 		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("recv %q timeout", want)
 	}
 }
 
-func TestHandleConn(t *testing.T) {
-	srv := New("3829", std)
-	var err error
-	srv.ln, err = net.Listen("tcp", ":"+srv.port)
-	if err != nil {
-		t.Fatalf("srv listen failed:%v", err)
+func TestDispatch(t *testing.T) {
+	srv := New("0", std)
+	if err := srv.SetMaxMessage(proto.MaxFrameSize); err == nil {
+		t.Errorf("max message too large, want error")
+	}
+	srv.SetMaxMessage(6)
+	sess := &session{token: "t1"}
+	srv.claimNick("tom", sess)
+	srv.claimNick("jerry", &session{token: "t2"})
+	name := "tom"
+	tests := []struct {
+		in   *proto.Frame
+		kind msgKind
+		room string
+		text string
+	}{
+		{proto.New(proto.TypeMsg, "", "", "hello"), msgText, DefaultRoom, "hello"},
+		{proto.New(proto.TypeMsg, "", "go", "a\nb"), msgText, "go", "a\nb"},
+		{proto.New(proto.TypeMsg, "", "go", "toolong"), msgReply, "", "message is too large (7 > 6 bytes)"},
+		{&proto.Frame{Type: proto.TypeDirect, To: "jerry", Text: "多行\n"}, msgReply, "", "message is too large (7 > 6 bytes)"},
+		{proto.New(proto.TypeJoin, "", "go", ""), msgJoin, "go", ""},
+		{proto.New(proto.TypePart, "", "go", ""), msgPart, "go", ""},
+		{proto.New(proto.TypeJoin, "", "bad room", ""), msgReply, "", "room[bad room] contains invalid characters"},
+		{proto.New(proto.TypeNick, "", "", "jerry"), msgReply, "", "nick[jerry] is already in use"},
+		{proto.New(proto.TypeNick, "", "", "spike"), msgNick, DefaultRoom, "tom"},
+		{proto.New(proto.TypePing, "", "", "1"), msgReply, "", "1"},
+		{&proto.Frame{Type: proto.TypeHistory, Room: "go", Count: 5}, msgHistory, "go", ""},
+		{&proto.Frame{Type: proto.TypeDirect, To: "jerry", Text: "hi"}, msgDirect, DefaultRoom, "hi"},
+		{&proto.Frame{Type: proto.TypeDirect, Text: "hi"}, msgReply, "", "nick length should be in [1, 32]"},
+		{proto.New(proto.TypeWelcome, "", "", ""), msgReply, "", "unsupported frame type[welcome]"},
+	}
+	for _, test := range tests {
+		msg := srv.dispatch(test.in, nil, sess, &name)
+		text := msg.text
+		if msg.kind == msgReply {
+			text = msg.frame.Text
+		} else if msg.room != test.room {
+			t.Errorf("dispatch %#v got room %q, want %q", test.in, msg.room, test.room)
+		}
+		if msg.kind != test.kind || text != test.text {
+			t.Errorf("dispatch %#v got %d %q, want %d %q", test.in, msg.kind, text, test.kind, test.text)
+		}
 	}
+	if name != "spike" || srv.nicks["tom"] != nil || srv.nicks["spike"] != sess {
+		t.Errorf("nick should be changed to spike, got %s %v", name, srv.nicks)
+	}
+}
+
+//hello 完成握手
+func hello(conn net.Conn, nick string) (*proto.Reader, *proto.Frame, error) {
+	if err := proto.Write(conn, proto.New(proto.TypeHello, nick, "", "")); err != nil {
+		return nil, nil, err
+	}
+	r := proto.NewReader(conn)
+	f, err := r.Read()
+	return r, f, err
+}
+
+func TestHandleConn(t *testing.T) {
+	srv := New("0", std)
+	dial := listen(t, srv)
 	defer srv.ln.Close()
 	go func() {
 		for i := 0; i < 2; i++ {
 			conn, err := srv.ln.Accept()
 			if err != nil {
-				t.Fatalf("acept error:%v", err)
+				t.Errorf("acept error:%v", err)
+				return
 			}
 			srv.stopper1.N.Add(1)
 			srv.handleConn(conn, srv.stopper1)
 		}
 	}()
 
-	conn, err := net.Dial("tcp", "localhost:"+srv.port)
-	if err != nil {
-		t.Fatalf("dial error: %v", err)
-	}
+	conn := dial()
 	defer conn.Close()
-	select {
-	case msg := <-srv.messages:
-		fmt.Println(msg)
-	case <-time.After(2 * time.Second):
-		t.Fatalf("srv.messages does not receive message")
+	reader, f, err := hello(conn, "tom")
+	if err != nil || f.Type != proto.TypeWelcome || f.From != "tom" {
+		t.Fatalf("handshake got %v %v, want welcome tom", f, err)
 	}
 	var cli client
 	select {
-	case cli = <-srv.entering:
-		//do nothing
+	case msg := <-srv.messages:
+		if msg.kind != msgEnter || msg.room != DefaultRoom || msg.name != "tom" {
+			t.Fatalf("got %#v, want entering %s", msg, DefaultRoom)
+		}
+		cli = msg.cli
 	case <-time.After(2 * time.Second):
-		t.Fatalf("srv.entering does not receive message")
+		t.Fatalf("srv.messages does not receive message")
 	}
 
-	writer := bufio.NewWriter(conn)
-	_, err = writer.WriteString("你好" + "\n")
-	if err != nil {
-		t.Fatalf("write error:%v", err)
+	for _, f := range []*proto.Frame{
+		proto.New(proto.TypeMsg, "", "", "你好"),
+		proto.New(proto.TypeJoin, "", "go", ""),
+		proto.New(proto.TypeMsg, "", "go", "在go"),
+		proto.New(proto.TypeNick, "", "", "jerry"),
+	} {
+		if err := proto.Write(conn, f); err != nil {
+			t.Fatalf("write error:%v", err)
+		}
 	}
-	writer.Flush()
-	select {
-	case msg := <-srv.messages:
-		if strings.Index(msg, "你好") < 0 {
-			t.Fatalf("srv.messages should receive messsage")
+	for _, want := range []message{
+		{kind: msgText, room: DefaultRoom, text: "你好"},
+		{kind: msgJoin, room: "go"},
+		{kind: msgText, room: "go", text: "在go"},
+		{kind: msgNick, room: DefaultRoom, text: "tom"},
+	} {
+		select {
+		case msg := <-srv.messages:
+			if msg.kind != want.kind || msg.room != want.room || msg.text != want.text || msg.cli != cli {
+				t.Fatalf("got %#v, want %#v", msg, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("srv.messages recv timeout")
 		}
 	}
 
-	cli <- "你好"
-	scanner := bufio.NewScanner(conn)
-	if !scanner.Scan() && scanner.Err() != nil {
-		t.Fatalf("scan error :%v", scanner.Err())
+	cli <- proto.New(proto.TypeMsg, "tom", DefaultRoom, "你好")
+	f, err = reader.Read()
+	if err != nil {
+		t.Fatalf("read error :%v", err)
 	}
-	if scanner.Text() != "你好" {
-		t.Fatalf("scnner.Text() does not correct")
+	if f.Text != "你好" {
+		t.Fatalf("f.Text does not correct")
 	}
 
 	conn.Close()
 	select {
 	case msg := <-srv.messages:
-		fmt.Println(msg)
+		if msg.kind != msgLeave || msg.cli != cli || msg.name != "jerry" {
+			t.Fatalf("srv.messages did not recv leaving of cli")
+		}
 	case <-time.After(2 * time.Second):
 		t.Fatalf("srv.messages recv timeout")
 	}
-	select {
-	case c := <-srv.leaving:
-		if c != cli {
-			t.Fatalf("srv.leaving did not recv cli")
+	//离开消息入队后才释放昵称
+	for i := 0; srv.claimNick("jerry", &session{}) != nil; i++ {
+		if i > 100 {
+			t.Fatalf("nick jerry should be released")
 		}
+		time.Sleep(10 * time.Millisecond)
 	}
 
-	conn2, err := net.Dial("tcp", "localhost:"+srv.port)
-	if err != nil {
-		t.Fatalf("dial error: %v", err)
-	}
+	conn2 := dial()
 	defer conn2.Close()
+	hello(conn2, "tom")
+	//结束时服务端发送close帧，内存连接须有人读取
+	go io.Copy(io.Discard, conn2)
 	var cli2 client
 	select {
-	case cli2 = <-srv.entering:
-		//do nothing
+	case msg := <-srv.messages:
+		cli2 = msg.cli
 	}
 	close(srv.stopper1.StopCh)
 	select {
-	case c := <-srv.leaving:
-		if c != cli2 {
-			t.Fatalf("srv.leaving did not recv cli2")
+	case msg := <-srv.messages:
+		if msg.kind != msgLeave || msg.cli != cli2 {
+			t.Fatalf("srv.messages did not recv leaving of cli2")
 		}
 	}
 	srv.stopper1.N.Wait()
 }
 
+func TestHandshake(t *testing.T) {
+	srv := New("0", std)
+	dial := listen(t, srv)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer srv.ShutDown()
+	tests := []struct {
+		in   *proto.Frame
+		want proto.Type
+		text string
+	}{
+		{proto.New(proto.TypeHello, "tom", "", ""), proto.TypeWelcome, ""},
+		{proto.New(proto.TypeHello, "tom", "", ""), proto.TypeError, "nick[tom] is already in use"},
+		{proto.New(proto.TypeMsg, "tom", "", "hi"), proto.TypeError, "hello is required"},
+		{proto.New(proto.TypeHello, "a[1]", "", ""), proto.TypeError, "nick[a[1]] contains invalid characters"},
+		{proto.New(proto.TypeHello, "10.0.0.5", "", ""), proto.TypeError, "nick[10.0.0.5] should not be an ip"},
+		{&proto.Frame{V: proto.Version + 1, Type: proto.TypeHello, From: "spike"}, proto.TypeError, proto.ErrVersion.Error()},
+		{proto.New(proto.TypeHello, "jerry", "", ""), proto.TypeWelcome, ""},
+	}
+	for _, test := range tests {
+		conn := dial()
+		defer conn.Close()
+		proto.Write(conn, test.in)
+		f, err := proto.NewReader(conn).Read()
+		if f != nil && f.Type == proto.TypeWelcome && len(f.Text) > 0 {
+			f.Text = "" //welcome携带会话token
+		}
+		if err != nil || f.Type != test.want || f.Text != test.text {
+			t.Errorf("handshake %#v got %v %v, want %s %q", test.in, f, err, test.want, test.text)
+		}
+	}
+}
+
+//readUntil 读取直到满足条件的帧
+func readUntil(t *testing.T, r *proto.Reader, match func(*proto.Frame) bool) *proto.Frame {
+	t.Helper()
+	for {
+		f, err := r.Read()
+		if err != nil {
+			t.Fatalf("read error:%v", err)
+		}
+		if match(f) {
+			return f
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	srv := New("0", std)
+	connect := listen(t, srv)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer srv.ShutDown()
+	dial := func(f *proto.Frame) (net.Conn, *proto.Reader, *proto.Frame) {
+		conn := connect()
+		proto.Write(conn, f)
+		r := proto.NewReader(conn)
+		reply, err := r.Read()
+		if err != nil {
+			t.Fatalf("handshake error: %v", err)
+		}
+		return conn, r, reply
+	}
+	msgText := func(text string) func(*proto.Frame) bool {
+		return func(f *proto.Frame) bool { return f.Type == proto.TypeMsg && f.Text == text }
+	}
+
+	conn1, r1, welcome := dial(proto.New(proto.TypeHello, "tom", "", ""))
+	defer conn1.Close()
+	token := welcome.Text
+	if welcome.Type != proto.TypeWelcome || len(token) == 0 || len(welcome.Epoch) == 0 {
+		t.Fatalf("got %v, want welcome with token and epoch", welcome)
+	}
+	proto.Write(conn1, proto.New(proto.TypeJoin, "", "go", ""))
+	proto.Write(conn1, proto.New(proto.TypeMsg, "", "go", "first"))
+	id := readUntil(t, r1, msgText("first")).ID
+	connJ, rj, _ := dial(proto.New(proto.TypeHello, "jerry", "", ""))
+	defer connJ.Close()
+	proto.Write(connJ, proto.New(proto.TypeJoin, "", "go", ""))
+	readUntil(t, rj, func(f *proto.Frame) bool { return f.Type == proto.TypeJoin && f.From == "jerry" && f.Room == "go" })
+
+	//token不符不能接管
+	conn, _, f := dial(proto.New(proto.TypeHello, "tom", "", "bad"))
+	conn.Close()
+	if f.Type != proto.TypeError {
+		t.Errorf("wrong token got %v, want error", f)
+	}
+
+	//同一token接管，旧连接被关闭
+	resume := proto.New(proto.TypeHello, "tom", "", token)
+	resume.ID = id
+	resume.Epoch = welcome.Epoch
+	resume.Rooms = []string{"go"}
+	conn2, r2, f := dial(resume)
+	defer conn2.Close()
+	if f.Type != proto.TypeWelcome || f.Text != token {
+		t.Fatalf("takeover got %v, want welcome", f)
+	}
+	for {
+		if _, err := r1.Read(); err != nil {
+			break
+		}
+	}
+	//其他人先看到旧连接离开，再看到新连接进入
+	f = readUntil(t, rj, func(f *proto.Frame) bool {
+		return (f.Type == proto.TypeJoin || f.Type == proto.TypePart) && f.From == "tom" && f.Room == "go"
+	})
+	if f.Type != proto.TypePart {
+		t.Errorf("takeover got %v first, want part", f)
+	}
+	readUntil(t, rj, func(f *proto.Frame) bool { return f.Type == proto.TypeJoin && f.From == "tom" && f.Room == "go" })
+	proto.Write(conn2, proto.New(proto.TypeMsg, "", "go", "missed"))
+	readUntil(t, r2, msgText("missed"))
+	conn2.Close()
+
+	//重连只补发id之后的消息
+	conn3, r3, f := dial(resume)
+	defer conn3.Close()
+	if f.Type != proto.TypeWelcome {
+		t.Fatalf("resume got %v, want welcome", f)
+	}
+	if f := readUntil(t, r3, func(f *proto.Frame) bool { return f.Type == proto.TypeMsg }); f.Text != "missed" || f.Room != "go" {
+		t.Errorf("resume replay got %v, want missed", f)
+	}
+	readUntil(t, r3, func(f *proto.Frame) bool { return f.Type == proto.TypeJoin && f.Room == "go" })
+
+	//其他纪元的ID或超过最后一条的ID（服务端重启过）按普通进入回放
+	for _, epoch := range []string{"stale", welcome.Epoch} {
+		other := proto.New(proto.TypeHello, "spike", "", "")
+		other.ID = id
+		if epoch == welcome.Epoch {
+			other.ID = 900
+		}
+		other.Epoch = epoch
+		other.Rooms = []string{"go"}
+		conn, r, f := dial(other)
+		if f.Type != proto.TypeWelcome {
+			t.Fatalf("epoch %s got %v, want welcome", epoch, f)
+		}
+		if f := readUntil(t, r, func(f *proto.Frame) bool { return f.Type == proto.TypeMsg }); f.Text != "first" {
+			t.Errorf("epoch %s replay got %v, want first", epoch, f)
+		}
+		conn.Close()
+		readUntil(t, rj, func(f *proto.Frame) bool { return f.Type == proto.TypePart && f.From == "spike" })
+	}
+}
+
+func TestUseAuth(t *testing.T) {
+	srv := New("0", std)
+	if err := srv.UseAuth(nil, true); err == nil {
+		t.Errorf("nil users, want error")
+	}
+	users, err := auth.OpenFile(filepath.Join(t.TempDir(), "users"))
+	if err != nil {
+		t.Fatalf("OpenFile error:%v", err)
+	}
+	users.Add("tom", "secret")
+	srv.UseAuth(users, true)
+	dialOpen := listen(t, srv)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer srv.ShutDown()
+	closed := New("0", std)
+	closed.UseAuth(users, false)
+	dialClosed := listen(t, closed)
+	if err := closed.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer closed.ShutDown()
+	tests := []struct {
+		dial           func() net.Conn
+		nick, password string
+		want           proto.Type
+	}{
+		{dialOpen, "tom", "wrong", proto.TypeError},
+		{dialOpen, "tom", "", proto.TypeError},
+		{dialOpen, "jerry", "", proto.TypeWelcome},
+		{dialOpen, "tom", "secret", proto.TypeWelcome},
+		{dialClosed, "spike", "", proto.TypeError},
+		{dialClosed, "spike", "secret", proto.TypeError},
+	}
+	for i, test := range tests {
+		conn := test.dial()
+		defer conn.Close()
+		proto.Write(conn, proto.New(proto.TypeHello, test.nick, "", ""))
+		r := proto.NewReader(conn)
+		f, err := r.Read()
+		if err == nil && f.Type == proto.TypeAuth {
+			if len(test.password) > 0 {
+				proto.Write(conn, proto.New(proto.TypeAuth, "", "", test.password))
+			} else {
+				proto.Write(conn, proto.New(proto.TypeMsg, "", "", "hi"))
+			}
+			f, err = r.Read()
+		}
+		if err != nil || f.Type != test.want {
+			t.Errorf("test%d got %v %v, want %s", i, f, err, test.want)
+		}
+	}
+
+	if err := srv.nickAllowed("tom"); err == nil {
+		t.Errorf("registered nick, want error")
+	}
+	if err := srv.nickAllowed("spike"); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	if err := closed.nickAllowed("spike"); err == nil {
+		t.Errorf("login required, want error")
+	}
+}
+
+//stubUsers 明文的账户，避免测试中计算哈希
+type stubUsers map[string]string
+
+func (u stubUsers) Exists(name string) bool {
+	_, ok := u[name]
+	return ok
+}
+
+func (u stubUsers) Verify(name, secret string) error {
+	if pw, ok := u[name]; !ok || pw != secret {
+		return auth.ErrSecret
+	}
+	return nil
+}
+
+func TestLoginLimit(t *testing.T) {
+	srv := New("0", std)
+	srv.UseAuth(stubUsers{"tom": "secret", "jerry": "secret"}, true)
+	dial := listen(t, srv)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer srv.ShutDown()
+	login := func(nick, password string) *proto.Frame {
+		conn := dial()
+		defer conn.Close()
+		proto.Write(conn, proto.New(proto.TypeHello, nick, "", ""))
+		r := proto.NewReader(conn)
+		f, err := r.Read()
+		if err == nil && f.Type == proto.TypeAuth {
+			proto.Write(conn, proto.New(proto.TypeAuth, "", "", password))
+			f, err = r.Read()
+		}
+		if err != nil {
+			t.Fatalf("login %s error:%v", nick, err)
+		}
+		return f
+	}
+	for i := 0; i < maxLoginFailures; i++ {
+		if f := login("tom", "wrong"); f.Text != errLogin.Error() {
+			t.Errorf("failure%d got %v, want %v", i, f, errLogin)
+		}
+	}
+	if f := login("tom", "secret"); f.Type != proto.TypeError || f.Text != "too many failed logins, try again later" {
+		t.Errorf("after failures got %v, want too many failed logins", f)
+	}
+	//内存连接没有IP，按昵称计算
+	if f := login("jerry", "secret"); f.Type != proto.TypeWelcome {
+		t.Errorf("jerry got %v, want welcome", f)
+	}
+
+	l := newLoginLimit()
+	now := time.Now()
+	for i := 0; i < maxLoginFailures; i++ {
+		l.fail("10.0.0.5", now)
+	}
+	if l.allow("10.0.0.5", now) || !l.allow("10.0.0.6", now) {
+		t.Errorf("only 10.0.0.5 should be blocked")
+	}
+	if !l.allow("10.0.0.5", now.Add(loginBlock)) {
+		t.Errorf("block should expire")
+	}
+}
+
+func TestModerate(t *testing.T) {
+	srv := New("0", std)
+	connect := listen(t, srv)
+	bansFile := filepath.Join(t.TempDir(), "bans")
+	if err := srv.UseBans(bansFile); err != nil {
+		t.Fatalf("UseBans error:%v", err)
+	}
+	srv.AddOp("tom")
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer srv.ShutDown()
+	//在ShutDown之前关闭，不读取的内存连接会阻塞服务端的写入
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	dial := func(nick string) (net.Conn, *proto.Reader, *proto.Frame) {
+		conn := connect()
+		conns = append(conns, conn)
+		r, f, err := hello(conn, nick)
+		if err != nil {
+			t.Fatalf("hello error: %v", err)
+		}
+		return conn, r, f
+	}
+	mod := func(conn net.Conn, typ proto.Type, target string) {
+		f := proto.New(typ, "", "", "")
+		f.To = target
+		proto.Write(conn, f)
+	}
+	is := func(typ proto.Type, text string) func(*proto.Frame) bool {
+		return func(f *proto.Frame) bool { return f.Type == typ && (len(text) == 0 || f.Text == text) }
+	}
+	closed := func(r *proto.Reader) {
+		for {
+			if _, err := r.Read(); err != nil {
+				return
+			}
+		}
+	}
+
+	tom, rt, _ := dial("tom")
+	defer tom.Close()
+	jerry, rj, _ := dial("jerry")
+	defer jerry.Close()
+
+	mod(jerry, proto.TypeKick, "tom")
+	readUntil(t, rj, is(proto.TypeError, "you are not an operator"))
+
+	mod(tom, proto.TypeMute, "jerry")
+	readUntil(t, rj, is(proto.TypeMute, ""))
+	proto.Write(jerry, proto.New(proto.TypeMsg, "", "", "hi"))
+	readUntil(t, rj, is(proto.TypeError, "you are muted"))
+	//重连不能解除禁言
+	jerry.Close()
+	readUntil(t, rt, is(proto.TypePart, ""))
+	jerry, rj, _ = dial("jerry")
+	readUntil(t, rj, is(proto.TypeNotice, "you are muted"))
+	proto.Write(jerry, proto.New(proto.TypeMsg, "", "", "hi"))
+	readUntil(t, rj, is(proto.TypeError, "you are muted"))
+	mod(tom, proto.TypeMute, "jerry")
+	readUntil(t, rt, is(proto.TypeError, "[jerry] is already muted"))
+	mod(tom, proto.TypeUnmute, "jerry")
+	readUntil(t, rj, is(proto.TypeUnmute, ""))
+	proto.Write(jerry, proto.New(proto.TypeMsg, "", "", "hi"))
+	readUntil(t, rj, is(proto.TypeMsg, "hi"))
+
+	mod(tom, proto.TypeKick, "jerry")
+	readUntil(t, rj, is(proto.TypeKick, ""))
+	closed(rj)
+	readUntil(t, rt, is(proto.TypePart, "kicked"))
+
+	jerry, rj, _ = dial("jerry")
+	defer jerry.Close()
+	//握手成功时还未进入，等进入后再封禁
+	readUntil(t, rj, is(proto.TypeJoin, ""))
+	mod(tom, proto.TypeBan, "jerry")
+	readUntil(t, rj, is(proto.TypeBan, ""))
+	closed(rj)
+	if _, _, f := dial("jerry"); f.Type != proto.TypeError {
+		t.Errorf("banned, got %v", f)
+	}
+	mod(tom, proto.TypeBan, "jerry")
+	readUntil(t, rt, is(proto.TypeError, "[jerry] is already banned"))
+	proto.Write(tom, proto.New(proto.TypeNick, "", "", "jerry"))
+	readUntil(t, rt, is(proto.TypeError, "nick[jerry] is banned"))
+	if bans, err := loadBans(bansFile); err != nil || !bans.banned("jerry", "") {
+		t.Errorf("bans should be persisted, got %v", err)
+	}
+
+	mod(tom, proto.TypeUnban, "jerry")
+	readUntil(t, rt, is(proto.TypeUnban, ""))
+	jerry, rj, f := dial("jerry")
+	if f.Type != proto.TypeWelcome {
+		t.Fatalf("unbanned, got %v", f)
+	}
+	if bans, _ := loadBans(bansFile); bans.banned("jerry", "") {
+		t.Errorf("unban should be persisted")
+	}
+
+	//管理员身份属于会话，改名后仍是管理员，占用原昵称的连接不是
+	readUntil(t, rj, is(proto.TypeJoin, ""))
+	mod(tom, proto.TypeOp, "jerry")
+	readUntil(t, rj, is(proto.TypeOp, ""))
+	proto.Write(tom, proto.New(proto.TypeNick, "", "", "tom2"))
+	readUntil(t, rt, is(proto.TypeNick, "tom2"))
+	fake, rf, _ := dial("tom")
+	readUntil(t, rf, is(proto.TypeJoin, ""))
+	mod(fake, proto.TypeKick, "jerry")
+	readUntil(t, rf, is(proto.TypeError, "you are not an operator"))
+	mod(tom, proto.TypeMute, "tom")
+	readUntil(t, rf, is(proto.TypeMute, ""))
+	mod(jerry, proto.TypeKick, "tom")
+	readUntil(t, rf, is(proto.TypeKick, ""))
+	closed(rf)
+
+	//内存连接没有IP，与其地址同名的禁言不影响其他人
+	mod(jerry, proto.TypeMute, "pipe")
+	readUntil(t, rj, is(proto.TypeMute, ""))
+	proto.Write(jerry, proto.New(proto.TypeMsg, "", "", "still here"))
+	readUntil(t, rj, is(proto.TypeMsg, "still here"))
+}
+
+func TestBanList(t *testing.T) {
+	dir := t.TempDir()
+	bans, err := loadBans(filepath.Join(dir, "missing", "bans"))
+	if err != nil {
+		t.Fatalf("loadBans error:%v", err)
+	}
+	if changed, err := bans.update("jerry", true); !changed || err != nil {
+		t.Errorf("ban in missing directory got %v %v, want true nil", changed, err)
+	}
+	if saved, _ := loadBans(bans.path); !saved.banned("jerry", "") {
+		t.Errorf("ban should be saved")
+	}
+
+	//目录无法创建时保存失败，内存中也不封禁
+	os.WriteFile(filepath.Join(dir, "file"), nil, 0600)
+	bans = &banList{path: filepath.Join(dir, "file", "bans"), set: make(map[string]bool)}
+	if _, err := bans.update("jerry", true); err == nil {
+		t.Errorf("save should fail")
+	}
+	if bans.banned("jerry", "") {
+		t.Errorf("failed ban should be rolled back")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	//不读取的连接要靠内核缓冲，使用真实的端口
+	srv := New("0", std)
+	if err := srv.SetHeartbeat(time.Second, time.Second); err == nil {
+		t.Errorf("timeout not greater than interval, want error")
+	}
+	srv.SetHeartbeat(50*time.Millisecond, 300*time.Millisecond)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer srv.ShutDown()
+	dial := func(nick string) (net.Conn, *proto.Reader) {
+		conn, err := net.Dial("tcp", util.DialAddr(srv.Addr()))
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		r, _, err := hello(conn, nick)
+		if err != nil {
+			t.Fatalf("hello error: %v", err)
+		}
+		return conn, r
+	}
+	tom, rt := dial("tom")
+	defer tom.Close()
+	jerry, rj := dial("jerry")
+	defer jerry.Close()
+
+	//tom回复pong保持连接，jerry不回复
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		f, err := rt.Read()
+		if err != nil {
+			t.Fatalf("tom read error:%v", err)
+		}
+		if f.Type == proto.TypePing {
+			proto.Write(tom, proto.New(proto.TypePong, "", "", f.Text))
+		}
+		if f.Type == proto.TypePart && f.From == "jerry" {
+			if f.Text != "timed out" {
+				t.Errorf("got %v, want timed out", f)
+			}
+			break
+		}
+	}
+	if time.Now().After(deadline) {
+		t.Fatalf("jerry should time out")
+	}
+	for {
+		if _, err := rj.Read(); err != nil {
+			break
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(RateLimit{Messages: 2, Bytes: 100, Warn: 2, Kick: 3})
+	want := []limitAction{limitPass, limitPass, limitThrottle, limitWarn, limitKick}
+	for i, action := range want {
+		if got, wait := l.take(1, false); got != action || (got == limitPass) != (wait == 0) {
+			t.Errorf("take%d got %d %v, want %d", i, got, wait, action)
+		}
+	}
+	//超过字节数的单帧等待后通过
+	l = newLimiter(RateLimit{Bytes: 100})
+	if action, wait := l.take(150, false); action != limitThrottle || wait < 400*time.Millisecond || wait > 600*time.Millisecond {
+		t.Errorf("got %d %v, want throttle 500ms", action, wait)
+	}
+	//过长被丢弃的帧即使未超速也算超限
+	l = newLimiter(RateLimit{Kick: 2})
+	l.take(10, true)
+	if action, _ := l.take(10, true); action != limitKick {
+		t.Errorf("invalid frames got %d, want kick", action)
+	}
+	if err := New("0", std).SetRateLimit(RateLimit{Warn: 5, Kick: 2}); err == nil {
+		t.Errorf("warn greater than kick, want error")
+	}
+}
+
+func TestFlood(t *testing.T) {
+	srv := New("0", std)
+	srv.SetRateLimit(RateLimit{Messages: 5, Warn: 2, Kick: 4})
+	connect := listen(t, srv)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer srv.ShutDown()
+	dial := func(nick string) (net.Conn, *proto.Reader) {
+		conn := connect()
+		r, _, err := hello(conn, nick)
+		if err != nil {
+			t.Fatalf("hello error: %v", err)
+		}
+		return conn, r
+	}
+	tom, rt := dial("tom")
+	defer tom.Close()
+	jerry, rj := dial("jerry")
+	defer jerry.Close()
+	for i := 0; i < 20; i++ {
+		proto.Write(jerry, proto.New(proto.TypeMsg, "", "", "flood"))
+	}
+	var notices []string
+	var closed *proto.Frame
+	for {
+		f, err := rj.Read()
+		if err != nil {
+			break
+		}
+		switch f.Type {
+		case proto.TypeNotice:
+			notices = append(notices, f.Text)
+		case proto.TypeClose:
+			closed = f
+		}
+	}
+	want := "you are sending too fast, slow down|you are kicked for flooding"
+	if strings.Join(notices, "|") != want {
+		t.Errorf("got notices %q, want %q", notices, want)
+	}
+	//踢出时发送close，客户端不再重连
+	if closed == nil || closed.Text != "flooding" {
+		t.Errorf("got close %v, want flooding", closed)
+	}
+	var count int
+	for {
+		f := readUntil(t, rt, func(f *proto.Frame) bool {
+			return f.Type == proto.TypeMsg || (f.Type == proto.TypePart && f.From == "jerry")
+		})
+		if f.Type == proto.TypePart {
+			if f.Text != "flooding" {
+				t.Errorf("got %v, want flooding", f)
+			}
+			break
+		}
+		count++
+	}
+	//5条在容量内，之后3条限速后通过，第4次超限被踢出
+	if count != 8 {
+		t.Errorf("tom got %d messages, want 8", count)
+	}
+}
+
+func TestUseTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	srv := New("0", std)
+	fp, err := srv.UseTLS(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("UseTLS error:%v", err)
+	}
+	//再次调用加载已生成的证书
+	if fp2, err := New("0", std).UseTLS(certFile, keyFile); err != nil || fp2 != fp {
+		t.Fatalf("UseTLS got %s %v, want %s", fp2, err, fp)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer srv.ShutDown()
+
+	conn, err := tls.Dial("tcp", util.DialAddr(srv.Addr()), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	if got := util.Fingerprint(conn.ConnectionState().PeerCertificates[0].Raw); got != fp {
+		t.Errorf("fingerprint got %s, want %s", got, fp)
+	}
+	if _, f, err := hello(conn, "tom"); err != nil || f.Type != proto.TypeWelcome {
+		t.Errorf("handshake got %v %v, want welcome", f, err)
+	}
+}
+
 func TestShutDown(t *testing.T) {
 	var srv *Server
 	srv.ShutDown()
-	srv = New("2344", std)
+	srv = New("0", std)
 	srv.ShutDown()
 	if err := srv.Start(); err != nil {
 		t.Fatalf("Start error: %v", err)
 	}
-	conn1, err := net.Dial("tcp", "localhost:"+srv.port)
+	//conn1不读取，服务端的写入要靠内核缓冲，使用真实的端口
+	conn1, err := net.Dial("tcp", util.DialAddr(srv.Addr()))
 	if err != nil {
 		t.Fatalf("conn1 dial error:%v", err)
 	}
 	defer conn1.Close()
-	conn2, err := net.Dial("tcp", "localhost:"+srv.port)
+	hello(conn1, "tom")
+	conn2, err := net.Dial("tcp", util.DialAddr(srv.Addr()))
 	if err != nil {
 		t.Fatalf("conn2 dial error:%v", err)
 	}
@@ -202,3 +1080,323 @@ func TestShutDown(t *testing.T) {
 		t.Fatalf("ShutDown time out!")
 	}
 }
+
+func TestNewWithOptions(t *testing.T) {
+	if _, err := NewWithOptions(Options{ClientCap: -1}, std); err == nil {
+		t.Errorf("negative capacity should fail")
+	}
+	if _, err := NewWithOptions(Options{Heartbeat: time.Minute, IdleTimeout: time.Second}, std); err == nil {
+		t.Errorf("idle timeout less than heartbeat should fail")
+	}
+	srv, err := NewWithOptions(Options{
+		Addr:       "127.0.0.1:0",
+		MaxClients: 1,
+		Ops:        []string{"tom"},
+		MaxMessage: 16,
+	}, std)
+	if err != nil {
+		t.Fatalf("NewWithOptions error:%v", err)
+	}
+	if srv.Addr() != nil {
+		t.Errorf("Addr before Start should be nil")
+	}
+	if !srv.ops["tom"] {
+		t.Errorf("tom should be an operator")
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer srv.ShutDown()
+	if got := srv.Addr().String(); !strings.HasPrefix(got, "127.0.0.1:") || got == "127.0.0.1:0" {
+		t.Errorf("Addr got %s", got)
+	}
+
+	conn1, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("conn1 dial error:%v", err)
+	}
+	defer conn1.Close()
+	if _, f, err := hello(conn1, "tom"); err != nil || f.Type != proto.TypeWelcome || f.Count != 16 {
+		t.Fatalf("tom handshake got %v %v, want welcome", f, err)
+	}
+	conn2, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("conn2 dial error:%v", err)
+	}
+	defer conn2.Close()
+	if _, f, err := hello(conn2, "jerry"); err != nil || f.Type != proto.TypeError || f.Text != "server is full" {
+		t.Errorf("jerry handshake got %v %v, want server is full", f, err)
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		dial string
+	}{
+		{"unix:" + filepath.Join(t.TempDir(), "chat.sock"), ""},
+		{"127.0.0.1:0", "127.0.0.1:"},
+		{"tcp6:[::1]:0", "[::1]:"},
+		{"0", "localhost:"},
+	}
+	for _, test := range tests {
+		srv, err := NewWithOptions(Options{Addr: test.addr}, std)
+		if err != nil {
+			t.Fatalf("NewWithOptions(%s) error:%v", test.addr, err)
+		}
+		if err := srv.Start(); err != nil {
+			if strings.HasPrefix(test.addr, "tcp6:") {
+				t.Logf("skip %s: %v", test.addr, err)
+				continue
+			}
+			t.Fatalf("Start(%s) error:%v", test.addr, err)
+		}
+		//端口由系统分配，只比较前缀
+		got := util.DialAddr(srv.Addr())
+		if len(test.dial) == 0 {
+			test.dial = test.addr
+		}
+		if !strings.HasPrefix(got, test.dial) {
+			t.Errorf("DialAddr(%s) got %s, want %s", test.addr, got, test.dial)
+		}
+		network, address, _ := util.ParseAddr(got)
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			t.Fatalf("dial %s error:%v", test.dial, err)
+		}
+		if _, f, err := hello(conn, "tom"); err != nil || f.Type != proto.TypeWelcome {
+			t.Errorf("handshake on %s got %v %v, want welcome", test.addr, f, err)
+		}
+		conn.Close()
+		srv.ShutDown()
+	}
+	if _, err := NewWithOptions(Options{Addr: "localhost"}, std); err == nil {
+		t.Errorf("address without port should fail")
+	}
+}
+
+func TestMemnet(t *testing.T) {
+	ln := memnet.Listen("chat")
+	srv, err := NewWithOptions(Options{Listener: ln}, std)
+	if err != nil {
+		t.Fatalf("NewWithOptions error:%v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer srv.ShutDown()
+
+	got := make(chan *proto.Frame, 16)
+	tom := chatclient.New("chat", "tom", std, nil)
+	jerry := chatclient.New("chat", "jerry", std, func(f *proto.Frame) { got <- f })
+	for _, cli := range []*chatclient.Client{tom, jerry} {
+		cli.SetDialer(ln.DialContext)
+		if err := cli.EnterServer(); err != nil {
+			t.Fatalf("EnterServer error:%v", err)
+		}
+		defer cli.LeaveServer()
+	}
+	tom.Send("hello")
+	for {
+		select {
+		case f := <-got:
+			if f.Type != proto.TypeMsg {
+				continue
+			}
+			if f.From != "tom" || f.Text != "hello" {
+				t.Errorf("jerry got %v, want hello from tom", f)
+			}
+			return
+		case <-time.After(2 * time.Second):
+			t.Fatalf("jerry recv timeout")
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	ln := memnet.Listen("chat")
+	srv, _ := NewWithOptions(Options{Listener: ln}, std)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- srv.Serve(ctx) }()
+
+	conn, err := ln.Dial("", "")
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer conn.Close()
+	r, f, err := hello(conn, "tom")
+	if err != nil || f.Type != proto.TypeWelcome {
+		t.Fatalf("handshake got %v %v, want welcome", f, err)
+	}
+	go func() {
+		for {
+			if _, err := r.Read(); err != nil {
+				return
+			}
+		}
+	}()
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve got %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return")
+	}
+	if err := srv.Shutdown(context.Background()); err == nil {
+		t.Errorf("second Shutdown should fail")
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	dir := t.TempDir()
+	store, err := history.OpenFile(filepath.Join(dir, "history.log"))
+	if err != nil {
+		t.Fatalf("OpenFile error:%v", err)
+	}
+	srv, err := NewWithOptions(Options{Addr: "unix:" + filepath.Join(dir, "missing", "chat.sock"), History: store}, std)
+	if err != nil {
+		t.Fatalf("NewWithOptions error:%v", err)
+	}
+	if err := srv.Start(); err == nil {
+		t.Fatalf("listen in missing directory should fail")
+	}
+	//Start失败后Shutdown仍释放消息存储
+	srv.ShutDown()
+	if err := store.Append(proto.New(proto.TypeMsg, "tom", "", "hi")); err == nil {
+		t.Errorf("history should be closed")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	ln := memnet.Listen("chat")
+	srv, _ := NewWithOptions(Options{Listener: ln}, std)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	//net.Pipe没有缓冲，不读取时服务端的写入一直阻塞
+	conn, err := ln.Dial("", "")
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer conn.Close()
+	if _, f, err := hello(conn, "tom"); err != nil || f.Type != proto.TypeWelcome {
+		t.Fatalf("handshake got %v %v, want welcome", f, err)
+	}
+	//只读取下一帧的1字节，服务端阻塞在写入中
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Fatalf("read error:%v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown got %v, want deadline exceeded", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Shutdown took %v", d)
+	}
+}
+
+func TestShutdownGrace(t *testing.T) {
+	ln := memnet.Listen("chat")
+	srv, _ := NewWithOptions(Options{Listener: ln, ShutdownGrace: 200 * time.Millisecond}, std)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	conn, err := ln.Dial("", "")
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer conn.Close()
+	r, f, err := hello(conn, "tom")
+	if err != nil || f.Type != proto.TypeWelcome {
+		t.Fatalf("handshake got %v %v, want welcome", f, err)
+	}
+	frames := make(chan *proto.Frame, 16)
+	go func() {
+		defer close(frames)
+		for {
+			f, err := r.Read()
+			if err != nil {
+				return
+			}
+			frames <- f
+		}
+	}()
+	//跳过进入时的通知
+	until := func(want string) {
+		t.Helper()
+		for f := range frames {
+			if f.String()[len("15:04:05 "):] == want {
+				return
+			}
+		}
+		t.Fatalf("recv %q failed", want)
+	}
+	done := make(chan error)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+	until("server shutting down in 1 seconds")
+	//宽限期内照常收发
+	proto.Write(conn, proto.New(proto.TypeMsg, "", "", "bye"))
+	expect(t, frames, "#lobby [tom]: bye")
+	expect(t, frames, "server closed the connection (server shutting down).")
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown got %v, want nil", err)
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	srv := New("0", std)
+	srv.stopper1.N.Add(1)
+	go srv.broadcast(srv.stopper1)
+	defer srv.stopper1.Stop()
+	//已握手的客户端可能在通知之后才进入
+	srv.messages <- message{kind: msgAnnounce, text: "server shutting down in 1 seconds"}
+	cli := make(chan *proto.Frame, capClient)
+	srv.messages <- message{kind: msgEnter, cli: cli, name: "tom", room: DefaultRoom}
+	expect(t, cli, "#lobby [tom] is entering.")
+	expect(t, cli, "server shutting down in 1 seconds")
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	bansFile, usersFile := filepath.Join(dir, "bans"), filepath.Join(dir, "users")
+	users, _ := auth.OpenFile(usersFile)
+	ln := memnet.Listen("chat")
+	srv, err := NewWithOptions(Options{Listener: ln, BansFile: bansFile, Users: users, Anonymous: true}, std)
+	if err != nil {
+		t.Fatalf("NewWithOptions error:%v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer srv.ShutDown()
+
+	//在服务器之外修改文件
+	os.WriteFile(bansFile, []byte("spike\n"), 0600)
+	other, _ := auth.OpenFile(usersFile)
+	other.Add("tom", "secret")
+	if err := srv.Reload(); err != nil {
+		t.Fatalf("Reload error:%v", err)
+	}
+	tests := []struct {
+		nick string
+		want proto.Type
+	}{
+		{"spike", proto.TypeError},
+		{"tom", proto.TypeAuth},
+	}
+	for _, test := range tests {
+		conn, err := ln.Dial("", "")
+		if err != nil {
+			t.Fatalf("dial error:%v", err)
+		}
+		defer conn.Close()
+		if _, f, err := hello(conn, test.nick); err != nil || f.Type != test.want {
+			t.Errorf("%s handshake got %v %v, want %s", test.nick, f, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+//SlowPolicy 客户端发送通道已满（消费太慢）时的处理策略
+//所有策略都在broadcast中同步执行，同一客户端收到的帧保持顺序
+type SlowPolicy int
+
+const (
+	DropOldest SlowPolicy = iota //丢弃通道中最旧的帧
+	DropNewest                   //丢弃新的帧
+	Disconnect                   //丢弃新的帧，连续丢弃超过threshold条后断开
+	Block                        //阻塞等待至多timeout，超时则断开
+)
+
+var slowPolicies = []string{"drop-oldest", "drop-newest", "disconnect", "block"}
+
+func (p SlowPolicy) String() string {
+	if p < 0 || int(p) >= len(slowPolicies) {
+		return fmt.Sprintf("SlowPolicy(%d)", int(p))
+	}
+	return slowPolicies[p]
+}
+
+//ParseSlowPolicy 解析drop-oldest、drop-newest、disconnect或block
+func ParseSlowPolicy(s string) (SlowPolicy, error) {
+	for i, name := range slowPolicies {
+		if name == s {
+			return SlowPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid slow consumer policy[%s]", s)
+}
+
+//SlowConsumer 慢消费者的处理配置
+type SlowConsumer struct {
+	Policy    SlowPolicy
+	Threshold int           //Disconnect时连续丢弃多少帧后断开
+	Timeout   time.Duration //Block时最长等待的时间
+}
+
+const (
+	defaultSlowThreshold int           = capClient
+	defaultSlowTimeout   time.Duration = time.Second
+)
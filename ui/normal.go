@@ -0,0 +1,294 @@
+package ui
+
+import (
+	"errors"
+	"strconv"
+	"unicode"
+)
+
+//normal 处理命令模式下的按键，像vim的普通模式一样编辑未发送的消息
+func (v *vim) normal(r rune) error {
+	pending := v.pending
+	v.pending = 0
+	switch r {
+	case '\x1b':
+		//取消输入了一半的命令
+		v.reset()
+		return nil
+	case '\x08', keyLeft:
+		r = 'h'
+	case keyRight:
+		r = 'l'
+	case keyHome:
+		r = '0'
+	case keyEnd:
+		r = '$'
+	case keyDelete:
+		r = 'x'
+	}
+	v.keys = append(v.keys, r)
+
+	if pending == 'r' {
+		v.replace(r)
+		return nil
+	}
+	if (r >= '1' && r <= '9') || (r == '0' && v.count > 0) {
+		v.count = v.count*10 + int(r-'0')
+		v.pending = pending
+		return nil
+	}
+	if pending == 'd' || pending == 'c' {
+		return v.operate(pending, r)
+	}
+
+	switch r {
+	case ':':
+		v.saved = append(v.saved[:0], v.buf...)
+		v.savedAt = v.cursor
+		v.clear()
+		v.reset()
+		v.mode = lastLine
+	case 'i':
+		v.startInsert()
+	case 'a':
+		if len(v.buf) > 0 {
+			v.cursor++
+		}
+		v.startInsert()
+	case 'A':
+		v.cursor = len(v.buf)
+		v.startInsert()
+	case 'I':
+		v.cursor = 0
+		for v.cursor < len(v.buf) && unicode.IsSpace(v.buf[v.cursor]) {
+			v.cursor++
+		}
+		v.startInsert()
+	case 'o':
+		//消息的各行在输入区显示为一行，o在消息末尾开始新的一行
+		v.cursor = len(v.buf)
+		v.insert('\n')
+		v.startInsert()
+	case newline:
+		v.reset()
+	case ctrlU:
+		v.scroll = scrollHalfUp
+		v.reset()
+	case ctrlD:
+		v.scroll = scrollHalfDown
+		v.reset()
+	case ctrlB:
+		v.scroll = scrollPageUp
+		v.reset()
+	case ctrlF:
+		v.scroll = scrollPageDown
+		v.reset()
+	case 'g':
+		if pending == 'g' {
+			v.scroll = scrollTop
+			v.reset()
+		} else {
+			v.pending = 'g'
+		}
+	case 'G':
+		v.scroll = scrollBottom
+		v.reset()
+	case 'h', 'l', 'w', 'b', 'e', '0', '$':
+		v.cursor, _ = v.motion(r, v.times())
+		v.reset()
+	case 'x':
+		return v.operate('d', 'l')
+	case 'D':
+		return v.operate('d', '$')
+	case 'C':
+		return v.operate('c', '$')
+	case 'd', 'c':
+		v.pending = r
+		v.opCount = v.count
+		v.count = 0
+	case 'r':
+		v.pending = 'r'
+	case '.':
+		v.repeat()
+	default:
+		v.reset()
+		return errors.New("invalid mode input")
+	}
+	return nil
+}
+
+//reset 结束当前的命令，命令模式下光标停在最后一个字符上
+func (v *vim) reset() {
+	v.pending = 0
+	v.count = 0
+	v.opCount = 0
+	v.keys = v.keys[:0]
+	v.recording = false
+	if v.mode == command && v.cursor >= len(v.buf) {
+		v.cursor = max(len(v.buf)-1, 0)
+	}
+}
+
+//change 当前的命令是一次修改，保存下来供.重复
+func (v *vim) change() {
+	if !v.replaying {
+		v.last = append(v.last[:0], v.keys...)
+	}
+	v.reset()
+}
+
+//startInsert 进入插入模式，之后输入的文本属于当前的修改
+func (v *vim) startInsert() {
+	v.mode = insert
+	v.pending = 0
+	v.count = 0
+	v.opCount = 0
+	v.recording = true
+}
+
+//times 命令的次数，2d3w为6次
+func (v *vim) times() int {
+	return max(v.count, 1) * max(v.opCount, 1)
+}
+
+//operate 对光标到motion之间的内容执行操作符d或c，dd、cc作用于整个消息
+func (v *vim) operate(op, motion rune) error {
+	n := v.times()
+	from, to := v.cursor, v.cursor
+	switch {
+	case motion == op:
+		from, to = 0, len(v.buf)
+	case op == 'c' && motion == 'w' && v.cursor < len(v.buf) && !unicode.IsSpace(v.buf[v.cursor]):
+		//cw在词上时与ce相同，不删除词后的空白
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				to = v.skipSpace(to)
+			}
+			to = v.wordEnd(to)
+		}
+	default:
+		var ok bool
+		if to, ok = v.motion(motion, n); !ok {
+			v.reset()
+			return errors.New("invalid mode input")
+		}
+		//包含终点字符的移动
+		if (motion == 'e' || motion == '$') && to < len(v.buf) {
+			to++
+		}
+		if to < from {
+			from, to = to, from
+		}
+	}
+	v.delete(from, to)
+	if op == 'c' {
+		v.startInsert()
+		return nil
+	}
+	v.change()
+	return nil
+}
+
+//motion 从光标移动n次后的位置，r不是移动键时返回false
+func (v *vim) motion(r rune, n int) (int, bool) {
+	i := v.cursor
+	switch r {
+	case 'h':
+		i = max(i-n, 0)
+	case 'l':
+		i = min(i+n, len(v.buf))
+	case '0':
+		i = 0
+	case '$':
+		i = max(len(v.buf)-1, 0)
+	case 'w':
+		for ; n > 0; n-- {
+			i = v.skipSpace(v.wordEnd(i))
+		}
+	case 'b':
+		for ; n > 0; n-- {
+			for i > 0 && unicode.IsSpace(v.buf[i-1]) {
+				i--
+			}
+			if i > 0 {
+				c := class(v.buf[i-1])
+				for i > 0 && class(v.buf[i-1]) == c {
+					i--
+				}
+			}
+		}
+	case 'e':
+		for ; n > 0 && i < len(v.buf)-1; n-- {
+			i = v.wordEnd(v.skipSpace(i+1)) - 1
+		}
+	default:
+		return v.cursor, false
+	}
+	return i, true
+}
+
+//wordEnd 从i开始的词之后的位置，i处为空白时返回i
+func (v *vim) wordEnd(i int) int {
+	if i >= len(v.buf) || unicode.IsSpace(v.buf[i]) {
+		return i
+	}
+	c := class(v.buf[i])
+	for i < len(v.buf) && class(v.buf[i]) == c {
+		i++
+	}
+	return i
+}
+
+func (v *vim) skipSpace(i int) int {
+	for i < len(v.buf) && unicode.IsSpace(v.buf[i]) {
+		i++
+	}
+	return i
+}
+
+//class 字符的类别，字母数字下划线组成一个词，连续的其他符号也组成一个词
+func class(r rune) int {
+	switch {
+	case unicode.IsSpace(r):
+		return 0
+	case r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+		return 1
+	default:
+		return 2
+	}
+}
+
+//replace 用r替换光标起的n个字符，不够n个时不替换
+func (v *vim) replace(r rune) {
+	n := v.times()
+	if unicode.IsControl(r) || (r >= keyLeft && r <= keyDelete) || v.cursor+n > len(v.buf) {
+		v.reset()
+		return
+	}
+	for i := 0; i < n; i++ {
+		v.buf[v.cursor+i] = r
+	}
+	v.cursor += n - 1
+	v.change()
+}
+
+//repeat 重复最后一次修改，输入了次数时代替原来的次数
+func (v *vim) repeat() {
+	keys := v.last
+	if v.count > 0 {
+		i := 0
+		for i < len(keys) && keys[i] >= '0' && keys[i] <= '9' {
+			i++
+		}
+		keys = append([]rune(strconv.Itoa(v.count)), keys[i:]...)
+	} else {
+		keys = append([]rune(nil), keys...)
+	}
+	v.reset()
+	v.replaying = true
+	for _, r := range keys {
+		v.handle(r)
+	}
+	v.replaying = false
+	v.last = keys
+}
@@ -0,0 +1,101 @@
+package ui
+
+import (
+	"fmt"
+
+	"github.com/nsf/termbox-go"
+)
+
+//maxScrollback 回滚缓冲保留的通知条数
+const maxScrollback = 5000
+
+//scrollback 通知区的回滚缓冲，保存通知原文，显示时再按宽度折行，只由Draw访问
+type scrollback struct {
+	lines  []string
+	offset int //从底部向上滚动的行数，0为显示最新的通知
+	width  int //上次显示的宽度，用于计算新通知占的行数
+}
+
+//add 添加通知，已向上滚动时保持显示的内容不动
+func (sb *scrollback) add(s string) {
+	if len(s) == 0 {
+		return
+	}
+	sb.lines = append(sb.lines, s)
+	if len(sb.lines) > maxScrollback {
+		sb.lines = append(sb.lines[:0], sb.lines[len(sb.lines)-maxScrollback:]...)
+	}
+	if sb.offset > 0 && sb.width > 0 {
+		sb.offset += len(string2Cell(s, sb.width)) / sb.width
+	}
+}
+
+//scroll 按动作滚动，height为通知区的行数，超出范围的在render时修正
+func (sb *scrollback) scroll(action scroll, height int) {
+	half := height / 2
+	if half == 0 {
+		half = 1
+	}
+	switch action {
+	case scrollHalfUp:
+		sb.offset += half
+	case scrollHalfDown:
+		sb.offset -= half
+	case scrollPageUp:
+		sb.offset += height
+	case scrollPageDown:
+		sb.offset -= height
+	case scrollTop:
+		sb.offset = maxOffset
+	case scrollBottom:
+		sb.offset = 0
+	}
+	if sb.offset < 0 {
+		sb.offset = 0
+	}
+}
+
+//maxOffset 用于gg，大于所有通知折行后的行数之和，render时修正
+const maxOffset = 1 << 30
+
+//render 将当前位置的一屏写入cells（width*height），不在底部时最后一行显示下方还有多少行
+func (sb *scrollback) render(cells []termbox.Cell, width, height int) {
+	sb.width = width
+	if width <= 0 || height <= 0 {
+		return
+	}
+	//从最新的通知向上折行，直到够显示offset处的一屏
+	var rows [][]termbox.Cell //自下而上
+	i := len(sb.lines) - 1
+	for ; i >= 0 && len(rows) < sb.offset+height; i-- {
+		c := string2Cell(sb.lines[i], width)
+		for j := len(c) - width; j >= 0; j -= width {
+			rows = append(rows, c[j:j+width])
+		}
+	}
+	if i < 0 && sb.offset > len(rows)-height {
+		//已经到最早的通知
+		sb.offset = len(rows) - height
+		if sb.offset < 0 {
+			sb.offset = 0
+		}
+	}
+	for y := 0; y < height; y++ {
+		line := cells[y*width : (y+1)*width]
+		if r := sb.offset + height - 1 - y; r < len(rows) {
+			copy(line, rows[r])
+		} else {
+			for x := range line {
+				line[x] = termbox.Cell{}
+			}
+		}
+	}
+	if sb.offset > 0 {
+		//提示覆盖的最后一行也算在下方
+		more := string2Cell(fmt.Sprintf("-- %d more line(s) below, G to bottom --", sb.offset+1), width)
+		line := cells[(height-1)*width : height*width]
+		for x := range line {
+			line[x] = termbox.Cell{Ch: more[x].Ch, Fg: termbox.AttrReverse}
+		}
+	}
+}
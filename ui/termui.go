@@ -2,6 +2,7 @@ package ui
 
 import (
 	"log"
+	"strings"
 
 	runewidth "github.com/mattn/go-runewidth"
 	"github.com/nsf/termbox-go"
@@ -33,9 +34,13 @@ import (
 type termui struct {
 	notifyCh chan string
 	inputCh  chan echo
+	scrollCh chan scroll
+	resizeCh chan struct{}
 	lock     chan bool
 	isInit   bool
 	v        *vim
+	sb       *scrollback
+	echo     echo //输入区最后显示的内容，改变大小时重画，只由Draw访问
 	logger   *log.Logger
 }
 
@@ -43,6 +48,7 @@ var ui termui
 
 type echo struct {
 	text       string
+	cursor     int //光标在text中的位置（按rune）
 	hideCursor bool
 }
 
@@ -53,10 +59,14 @@ func Init(l *log.Logger) {
 	termbox.SetInputMode(termbox.InputEsc)
 	ui.notifyCh = make(chan string, 1024)
 	ui.inputCh = make(chan echo, 1)
+	ui.scrollCh = make(chan scroll, 16)
+	ui.resizeCh = make(chan struct{}, 1)
 	ui.lock = make(chan bool, 1)
 	termbox.HideCursor()
 	termbox.Flush()
 	ui.v = newVim()
+	ui.sb = &scrollback{}
+	ui.echo = echo{hideCursor: true}
 	ui.logger = l
 	ui.isInit = true
 }
@@ -64,9 +74,12 @@ func Init(l *log.Logger) {
 func Close() {
 	close(ui.notifyCh)
 	close(ui.inputCh)
+	close(ui.scrollCh)
+	close(ui.resizeCh)
 	defer lockFunc()()
 	termbox.Close()
 	ui.v = nil
+	ui.sb = nil
 	ui.logger = nil
 	ui.isInit = false
 }
@@ -84,12 +97,31 @@ func Draw() {
 				<-ui.lock
 				return
 			}
-			scrollDownNotice(msg)
+			ui.sb.add(msg)
+			drawNotice()
+		case action, ok := <-ui.scrollCh:
+			if !ok {
+				<-ui.lock
+				return
+			}
+			_, h := termbox.Size()
+			ui.sb.scroll(action, h-1)
+			drawNotice()
+		case _, ok := <-ui.resizeCh:
+			if !ok {
+				<-ui.lock
+				return
+			}
+			//Clear同步新的大小，通知按新的宽度重新折行
+			termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
+			drawNotice()
+			refreshInputArea(ui.echo)
 		case echoText, ok := <-ui.inputCh:
 			if !ok {
 				<-ui.lock
 				return
 			}
+			ui.echo = echoText
 			refreshInputArea(echoText)
 		}
 		termbox.Flush()
@@ -104,74 +136,68 @@ func lockFunc() func() {
 	}
 }
 
-func scrollDownNotice(newStr string) {
-	if len(newStr) == 0 {
-		return
-	}
+//drawNotice 按回滚缓冲的当前位置重画通知区
+func drawNotice() {
 	w, h := termbox.Size()
-	cells := string2Cell(newStr, w)
-	msgArea := termbox.CellBuffer()[:w*(h-1)]
-	if len(cells) >= len(msgArea) {
-		copy(msgArea, cells[len(cells)-len(msgArea):])
-	} else {
-		copy(msgArea[:len(msgArea)-len(cells)], msgArea[len(cells):])
-		copy(msgArea[len(msgArea)-len(cells):], cells)
+	if h < 2 {
+		return
 	}
+	ui.sb.render(termbox.CellBuffer()[:w*(h-1)], w, h-1)
 }
 
 func refreshInputArea(echoText echo) {
 	w, h := termbox.Size()
-	cells := termbox.CellBuffer()[w*(h-1):]
-	rs := []rune(echoText.text)
-	j := len(cells) - 2
-	for i := len(rs) - 1; i >= 0 && j >= 0; i-- {
-		w := runewidth.RuneWidth(rs[i])
-		if w == 0 || (w == 2 && runewidth.IsAmbiguousWidth(rs[i])) {
-			w = 1
-		}
-		if j < w-1 {
-			for ; j >= 0; j-- {
-				cells[j] = termbox.Cell{}
-			}
-			break
-		}
-		for k := j; k > j-w+1; k-- {
-			cells[k] = termbox.Cell{}
-		}
-		cells[j-w+1] = termbox.Cell{Ch: rs[i]}
-		j = j - w
-	}
-	if j >= 0 {
-		copy(cells, cells[j+1:len(cells)-1])
-		for k := len(cells) - 1 - j - 1; k < len(cells); k++ {
-			cells[k] = termbox.Cell{}
-		}
-
-		if echoText.hideCursor {
-			termbox.HideCursor()
-		} else {
-			termbox.SetCursor(len(cells)-1-j-1, h-1)
-		}
+	if w < 1 || h < 1 {
 		return
 	}
+	cells, x := inputLine([]rune(echoText.text), echoText.cursor, w)
+	copy(termbox.CellBuffer()[w*(h-1):], cells)
 	if echoText.hideCursor {
 		termbox.HideCursor()
 	} else {
-		termbox.SetCursor(w-1, h-1)
+		termbox.SetCursor(x, h-1)
 	}
 }
 
+//inputLine 将输入的一行排成width个单元格，返回光标所在的列
+//放不下时只显示光标附近的部分，光标之后至少留出一列
+func inputLine(rs []rune, cursor, width int) ([]termbox.Cell, int) {
+	widths := make([]int, len(rs))
+	for i, r := range rs {
+		widths[i] = runewidth.RuneWidth(r)
+		if widths[i] == 0 || (widths[i] == 2 && runewidth.IsAmbiguousWidth(r)) {
+			widths[i] = 1
+		}
+	}
+	//光标前的内容放不下时从右向左取到刚好放下
+	start, x := cursor, 0
+	for start > 0 && x+widths[start-1] <= width-1 {
+		start--
+		x += widths[start]
+	}
+	cells := make([]termbox.Cell, width)
+	col := 0
+	for i := start; i < len(rs) && col+widths[i] <= width; i++ {
+		cells[col] = termbox.Cell{Ch: rs[i]}
+		col += widths[i]
+	}
+	return cells, x
+}
+
 func string2Cell(s string, width int) []termbox.Cell {
 	cells := make([]termbox.Cell, 0, len(s))
 	var x int
+	var wrapped bool //上一行刚好写满而自动换行，紧接的换行符不再产生空行
 	for _, r := range s {
 		if r == '\n' {
-			if x > 0 {
+			if x > 0 || !wrapped {
+				//行首的换行符是一个空行
 				cells = append(cells, make([]termbox.Cell, width-x)...)
 			}
-			x = 0
+			x, wrapped = 0, false
 			continue
 		}
+		wrapped = false
 		w := runewidth.RuneWidth(r)
 		if w == 0 || (w == 2 && runewidth.IsAmbiguousWidth(r)) {
 			w = 1
@@ -186,7 +212,7 @@ func string2Cell(s string, width int) []termbox.Cell {
 		}
 		x += w
 		if x == width {
-			x = 0
+			x, wrapped = 0, true
 		}
 	}
 	if x > 0 && x < width {
@@ -195,6 +221,15 @@ func string2Cell(s string, width int) []termbox.Cell {
 	return cells
 }
 
+//editKeys 没有对应字符的编辑键
+var editKeys = map[termbox.Key]rune{
+	termbox.KeyArrowLeft:  keyLeft,
+	termbox.KeyArrowRight: keyRight,
+	termbox.KeyHome:       keyHome,
+	termbox.KeyEnd:        keyEnd,
+	termbox.KeyDelete:     keyDelete,
+}
+
 func Notify(s string) {
 	ui.notifyCh <- s
 }
@@ -210,9 +245,17 @@ func Scan() (out []string, isCmd bool, err error) {
 		case termbox.EventError:
 			err = ev.Err
 			return
+		case termbox.EventResize:
+			//连续改变大小时只需重画一次
+			select {
+			case ui.resizeCh <- struct{}{}:
+			default:
+			}
 		case termbox.EventKey:
 			r := ev.Ch
-			if ev.Key == termbox.KeyEnter {
+			if ev.Key == termbox.KeyCtrlJ {
+				r = newline
+			} else if ev.Key == termbox.KeyEnter {
 				r = '\n'
 			} else if ev.Key == termbox.KeyEsc {
 				r = '\x1b'
@@ -222,19 +265,26 @@ func Scan() (out []string, isCmd bool, err error) {
 				r = '\x08'
 			} else if ev.Key == termbox.KeyTab {
 				r = '\t'
+			} else if ev.Key == termbox.KeyCtrlU || ev.Key == termbox.KeyCtrlD || ev.Key == termbox.KeyCtrlB ||
+				ev.Key == termbox.KeyCtrlF || ev.Key == termbox.KeyCtrlW {
+				r = rune(ev.Key)
+			} else if k, ok := editKeys[ev.Key]; ok {
+				r = k
 			} else if r == 0 {
 				continue
 			}
 			var finished bool
 			finished, out, isCmd, err = ui.v.handle(r)
-			var echoText echo
-			echoText.text = string(ui.v.buf)
-			if ui.v.mode == command {
-				echoText.hideCursor = true
+			if ui.v.scroll != scrollNone {
+				ui.scrollCh <- ui.v.scroll
 			}
+			var echoText echo
+			//多行消息在输入区显示为一行
+			echoText.text = strings.ReplaceAll(string(ui.v.buf), "\n", "↵")
+			echoText.cursor = ui.v.cursor
 			if ui.v.mode == lastLine {
-				echoText.text = ":" + echoText.text + "_"
-				echoText.hideCursor = true
+				echoText.text = ":" + echoText.text
+				echoText.cursor++
 			}
 			ui.inputCh <- echoText
 			if finished {
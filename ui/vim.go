@@ -4,12 +4,24 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 )
 
 type vim struct {
-	mode Mode
-	buf  []rune
+	mode      Mode
+	buf       []rune
+	cursor    int    //光标在buf中的位置，0到len(buf)；命令模式下不超过最后一个字符
+	pending   rune   //命令模式下等待后续按键的前缀，如gg的g、dw的d、r
+	count     int    //命令模式下输入的次数，0表示没有输入
+	opCount   int    //操作符之前输入的次数，如2d3w的2
+	keys      []rune //正在输入的命令，是修改时保存到last供.重复
+	last      []rune //最后一次修改的按键
+	recording bool   //插入模式下的按键属于正在记录的修改，如cw之后输入的文本
+	replaying bool   //正在用.重复最后一次修改
+	saved     []rune //进入底行模式时未发送的消息，离开时恢复
+	savedAt   int    //进入底行模式时的光标
+	scroll    scroll //本次按键要求的通知区翻页，由termui执行
 }
 
 type Mode int
@@ -20,6 +32,40 @@ const (
 	lastLine
 )
 
+//newline 插入模式下在消息中换行（Ctrl-J），Enter则发送
+const newline = '\r'
+
+//命令模式下翻页的按键，插入模式下Ctrl-U删除到行首、Ctrl-W删除前一个词
+const (
+	ctrlB = '\x02'
+	ctrlD = '\x04'
+	ctrlF = '\x06'
+	ctrlU = '\x15'
+	ctrlW = '\x17'
+)
+
+//没有对应字符的按键，用Unicode私用区的码点表示
+const (
+	keyLeft rune = 0xE000 + iota
+	keyRight
+	keyHome
+	keyEnd
+	keyDelete
+)
+
+//scroll 通知区的翻页
+type scroll int
+
+const (
+	scrollNone     scroll = iota
+	scrollHalfUp          //Ctrl-U，向上半屏
+	scrollHalfDown        //Ctrl-D，向下半屏
+	scrollPageUp          //Ctrl-B，向上一屏
+	scrollPageDown        //Ctrl-F，向下一屏
+	scrollTop             //gg，到最早的通知
+	scrollBottom          //G，到最新的通知
+)
+
 func newVim() *vim {
 	return &vim{buf: make([]rune, 0, 1024)}
 }
@@ -34,42 +80,48 @@ func (v *vim) handle(r rune) (finished bool, out []string, isCmd bool, err error
 	if !utf8.ValidRune(r) {
 		r = utf8.RuneError
 	}
+	v.scroll = scrollNone
 
 	switch v.mode {
 	case command:
-		switch r {
-		case ':':
-			v.mode = lastLine
-		case 'i':
-			v.mode = insert
-		case '\x1b':
-			//esc do nothing
-		default:
-			err = errors.New("invalid mode input")
+		if err = v.normal(r); err != nil {
 			finished = true
 		}
 
 	case insert:
+		if v.recording {
+			v.keys = append(v.keys, r)
+		}
 		switch r {
 		case utf8.RuneError:
 			err = errors.New("invalid rune")
 			finished = true
-			v.buf = v.buf[:0]
+			v.clear()
+			v.reset()
 		case '\x1b':
+			//保留未发送的消息，光标像vim一样左移一个字符
 			v.mode = command
-			v.buf = v.buf[:0]
+			if v.cursor > 0 {
+				v.cursor--
+			}
+			if v.recording {
+				v.change()
+			}
+			v.reset()
 		case '\n':
 			out = []string{string(v.buf)}
 			isCmd = false
 			finished = true
-			v.buf = v.buf[:0]
-		case '\x08':
-			//backspace
-			if len(v.buf) > 0 {
-				v.buf = v.buf[:len(v.buf)-1]
-			}
+			v.clear()
+			v.reset()
+		case newline:
+			v.insert('\n')
+		case ctrlD, ctrlB, ctrlF:
+			//只用于命令模式
 		default:
-			v.buf = append(v.buf, r)
+			if !v.edit(r) {
+				v.insert(r)
+			}
 		}
 
 	case lastLine:
@@ -77,33 +129,103 @@ func (v *vim) handle(r rune) (finished bool, out []string, isCmd bool, err error
 		case utf8.RuneError:
 			err = errors.New("invalid rune")
 			finished = true
-			v.buf = v.buf[:0]
-			v.mode = command
+			v.leaveLastLine()
 		case '\x1b':
-			v.mode = command
-			v.buf = v.buf[:0]
+			v.leaveLastLine()
 		case '\n':
 			out = strings.Fields(string(v.buf))
 			isCmd = true
 			finished = true
-			v.buf = v.buf[:0]
-			v.mode = command
+			v.leaveLastLine()
+		case newline, ctrlD, ctrlB, ctrlF:
+			//命令只有一行
 		case '\x08':
-			//backspace
+			//backspace，命令为空时回到命令模式
 			if len(v.buf) > 0 {
-				v.buf = v.buf[:len(v.buf)-1]
+				v.edit(r)
 			} else {
-				v.mode = command
+				v.leaveLastLine()
 			}
 		default:
-			v.buf = append(v.buf, r)
+			if !v.edit(r) {
+				v.insert(r)
+			}
 		}
 
 	default:
 		err = fmt.Errorf("invalid mode %d", v.mode)
 		v.mode = command
-		v.buf = v.buf[:0]
+		v.clear()
 		finished = true
 	}
 	return
 }
+
+//leaveLastLine 回到命令模式并恢复进入底行模式前的消息
+func (v *vim) leaveLastLine() {
+	v.mode = command
+	v.buf = append(v.buf[:0], v.saved...)
+	v.cursor = v.savedAt
+	v.saved = v.saved[:0]
+}
+
+func (v *vim) clear() {
+	v.buf = v.buf[:0]
+	v.cursor = 0
+}
+
+//insert 在光标处插入r
+func (v *vim) insert(r rune) {
+	v.buf = append(v.buf, 0)
+	copy(v.buf[v.cursor+1:], v.buf[v.cursor:])
+	v.buf[v.cursor] = r
+	v.cursor++
+}
+
+//delete 删除[from, to)并将光标移到from
+func (v *vim) delete(from, to int) {
+	v.buf = append(v.buf[:from], v.buf[to:]...)
+	v.cursor = from
+}
+
+//edit 插入模式和底行模式共用的行编辑按键，r不是编辑键时返回false
+func (v *vim) edit(r rune) bool {
+	switch r {
+	case '\x08':
+		//backspace
+		if v.cursor > 0 {
+			v.delete(v.cursor-1, v.cursor)
+		}
+	case keyDelete:
+		if v.cursor < len(v.buf) {
+			v.delete(v.cursor, v.cursor+1)
+		}
+	case keyLeft:
+		if v.cursor > 0 {
+			v.cursor--
+		}
+	case keyRight:
+		if v.cursor < len(v.buf) {
+			v.cursor++
+		}
+	case keyHome:
+		v.cursor = 0
+	case keyEnd:
+		v.cursor = len(v.buf)
+	case ctrlW:
+		//删除光标前的空白和一个词
+		i := v.cursor
+		for i > 0 && unicode.IsSpace(v.buf[i-1]) {
+			i--
+		}
+		for i > 0 && !unicode.IsSpace(v.buf[i-1]) {
+			i--
+		}
+		v.delete(i, v.cursor)
+	case ctrlU:
+		v.delete(0, v.cursor)
+	default:
+		return false
+	}
+	return true
+}
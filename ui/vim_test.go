@@ -1,9 +1,11 @@
 package ui
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/liuc2050/easychat/util"
+	"github.com/nsf/termbox-go"
 )
 
 type TStep struct {
@@ -25,6 +27,8 @@ func TestScan(t *testing.T) {
 		{newVim(), []TStep{{":leave\n", []string{"leave"}, true, true, command}}},
 		{newVim(), []TStep{{":crea\x1bistill here\n", []string{"still here"}, false, true, insert}}},
 		{newVim(), []TStep{{"\n", []string{}, false, false, command}}},
+		{newVim(), []TStep{{"i第一行\r第二行\rx\x08\n", []string{"第一行\n第二行\n"}, false, true, insert}}},
+		{newVim(), []TStep{{"\r:join\r go\n", []string{"join", "go"}, true, true, command}}},
 		{newVim(), []TStep{{"idxk伯不可靠\uFFFD", []string{}, false, false, insert}}},
 		{newVim(), []TStep{{":bye\uFFFD", []string{}, false, false, command}}},
 		{newVim(), []TStep{
@@ -61,9 +65,236 @@ func scan(v *vim, s string) (finished bool, out []string, isCmd bool, err error)
 	return
 }
 
-func TestnewVim(t *testing.T) {
+func TestNewVim(t *testing.T) {
 	v := newVim()
 	if v.mode != command {
 		t.Errorf("mode %d, want %d", v.mode, command)
 	}
 }
+
+func TestScroll(t *testing.T) {
+	tests := []struct {
+		in   string
+		want scroll
+	}{
+		{"\x15", scrollHalfUp},
+		{"\x04", scrollHalfDown},
+		{"\x02", scrollPageUp},
+		{"\x06", scrollPageDown},
+		{"gg", scrollTop},
+		{"G", scrollBottom},
+		{"g", scrollNone},
+		{"i\x15", scrollNone},
+	}
+	for _, test := range tests {
+		v := newVim()
+		if _, _, _, err := scan(v, test.in); err != nil || v.scroll != test.want {
+			t.Errorf("input %q got %d %v, want %d", test.in, v.scroll, err, test.want)
+		}
+		if v.mode == insert && len(v.buf) != 0 {
+			t.Errorf("input %q should not be inserted, got %q", test.in, string(v.buf))
+		}
+	}
+}
+
+//rows 将cells按行转换为字符串，忽略空单元格
+func rows(cells []termbox.Cell, width int) []string {
+	var out []string
+	for i := 0; i < len(cells); i += width {
+		var b strings.Builder
+		for _, c := range cells[i : i+width] {
+			if c.Ch != 0 {
+				b.WriteRune(c.Ch)
+			}
+		}
+		out = append(out, strings.TrimRight(b.String(), " "))
+	}
+	return out
+}
+
+func TestScrollback(t *testing.T) {
+	const width, height = 10, 3
+	cells := make([]termbox.Cell, width*height)
+	sb := &scrollback{}
+	sb.render(cells, width, height)
+	if got := rows(cells, width); !util.StringSliceEqual(got, []string{"", "", ""}) {
+		t.Errorf("empty got %q", got)
+	}
+	for _, s := range []string{"a", "b", "0123456789xy", "c"} {
+		sb.add(s)
+	}
+	steps := []struct {
+		action scroll
+		want   []string
+	}{
+		{scrollNone, []string{"0123456789", "xy", "c"}},
+		{scrollHalfUp, []string{"b", "0123456789", "-- 2 more"}},
+		{scrollTop, []string{"a", "b", "-- 3 more"}},
+		{scrollHalfDown, []string{"b", "0123456789", "-- 2 more"}},
+		{scrollPageDown, []string{"0123456789", "xy", "c"}},
+		{scrollPageUp, []string{"a", "b", "-- 3 more"}},
+		{scrollBottom, []string{"0123456789", "xy", "c"}},
+	}
+	for i, step := range steps {
+		sb.scroll(step.action, height)
+		sb.render(cells, width, height)
+		if got := rows(cells, width); !util.StringSliceEqual(got, step.want) {
+			t.Errorf("step%d got %q, want %q", i, got, step.want)
+		}
+	}
+	//向上滚动时新的通知不改变显示的内容
+	sb.scroll(scrollHalfUp, height)
+	sb.add("d")
+	sb.render(cells, width, height)
+	if got := rows(cells, width); !util.StringSliceEqual(got, []string{"b", "0123456789", "-- 3 more"}) {
+		t.Errorf("after add got %q", got)
+	}
+}
+
+func TestReflow(t *testing.T) {
+	sb := &scrollback{}
+	sb.add("hello, 世界!")
+	sb.add("bye")
+	tests := []struct {
+		width, height int
+		want          []string
+	}{
+		{12, 2, []string{"hello, 世界!", "bye"}},
+		//宽字符放不下时整个移到下一行
+		{8, 3, []string{"hello,", "世界!", "bye"}},
+		{4, 4, []string{"o,", "世界", "!", "bye"}},
+	}
+	for _, test := range tests {
+		cells := make([]termbox.Cell, test.width*test.height)
+		sb.render(cells, test.width, test.height)
+		if got := rows(cells, test.width); !util.StringSliceEqual(got, test.want) {
+			t.Errorf("width %d got %q, want %q", test.width, got, test.want)
+		}
+	}
+}
+
+func TestString2Cell(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"a\n\nb", []string{"a", "", "b"}},
+		{"\nb", []string{"", "b"}},
+		//写满一行后的换行符不产生空行
+		{"abcd\ne", []string{"abcd", "e"}},
+		{"abcd\n\ne", []string{"abcd", "", "e"}},
+	}
+	for _, test := range tests {
+		if got := rows(string2Cell(test.s, 4), 4); !util.StringSliceEqual(got, test.want) {
+			t.Errorf("string2Cell(%q) got %q, want %q", test.s, got, test.want)
+		}
+	}
+}
+
+func TestEdit(t *testing.T) {
+	left, right, home, end, del := string(keyLeft), string(keyRight), string(keyHome), string(keyEnd), string(keyDelete)
+	tests := []struct {
+		in     string
+		buf    string
+		cursor int
+	}{
+		{"iabc" + left + "X", "abXc", 3},
+		{"iabc" + home + "X" + end + "Y", "XabcY", 5},
+		{"iabc" + left + left + "\x08", "bc", 0},
+		{"iabc" + home + del + right + del, "b", 1},
+		{"iabc" + left + left + left + left + right, "abc", 1},
+		{"isay hello  world\x17", "say hello  ", 11},
+		{"isay hello  world" + left + left + "\x17", "say hello  ld", 11},
+		{"isay hello" + left + left + "\x15", "lo", 0},
+		{"i世界" + left + "\r", "世\n界", 2},
+		{":jion" + left + left + "\x08" + right + "i", "join", 3},
+	}
+	for _, test := range tests {
+		v := newVim()
+		if _, _, _, err := scan(v, test.in); err != nil || string(v.buf) != test.buf || v.cursor != test.cursor {
+			t.Errorf("input %q got %q %d %v, want %q %d", test.in, string(v.buf), v.cursor, err, test.buf, test.cursor)
+		}
+	}
+	//发送之后光标回到开头
+	v := newVim()
+	if _, out, _, _ := scan(v, "iab"+left+"c\n"); len(out) != 1 || out[0] != "acb" || v.cursor != 0 {
+		t.Errorf("send got %q, cursor %d", out, v.cursor)
+	}
+}
+
+func TestNormal(t *testing.T) {
+	const base = "ione two three\x1b"
+	tests := []struct {
+		in     string
+		buf    string
+		cursor int
+	}{
+		{"", "one two three", 12},
+		{"0", "one two three", 0},
+		{"0w", "one two three", 4},
+		{"02w", "one two three", 8},
+		{"0e", "one two three", 2},
+		{"b", "one two three", 8},
+		{"0l" + string(keyRight) + "h", "one two three", 1},
+		{"0x", "ne two three", 0},
+		{"03x", " two three", 0},
+		{"0dw", "two three", 0},
+		{"02dw", "three", 0},
+		{"0d2w", "three", 0},
+		{"0de", " two three", 0},
+		{"db", "one two e", 8},
+		{"0d\x1bx", "ne two three", 0},
+		{"0wD", "one ", 3},
+		{"0wC2\x1b", "one 2", 4},
+		{"dd", "", 0},
+		{"0cwONE\x1b", "ONE two three", 2},
+		{"0cwONE\x1bw.", "ONE ONE three", 6},
+		{"0dw.", "three", 0},
+		{"0x3.", "two three", 0},
+		{"0rX", "Xne two three", 0},
+		{"03rx", "xxx two three", 2},
+		{"0aX\x1b", "oXne two three", 1},
+		{"0AX\x1b", "one two threeX", 13},
+		{"$IX\x1b", "Xone two three", 0},
+		{"oX\x1b", "one two three\nX", 14},
+		{":x\x1b", "one two three", 12},
+	}
+	for _, test := range tests {
+		v := newVim()
+		if _, _, _, err := scan(v, base+test.in); err != nil || string(v.buf) != test.buf || v.cursor != test.cursor || v.mode != command {
+			t.Errorf("input %q got %q %d %d %v, want %q %d", test.in, string(v.buf), v.cursor, v.mode, err, test.buf, test.cursor)
+		}
+	}
+	//执行命令之后恢复未发送的消息
+	v := newVim()
+	if _, out, _, _ := scan(v, base+":q\n"); len(out) != 1 || out[0] != "q" || string(v.buf) != "one two three" {
+		t.Errorf("command got %q, buf %q", out, string(v.buf))
+	}
+	if _, _, _, err := scan(v, "z"); err == nil {
+		t.Errorf("invalid key should fail")
+	}
+}
+
+func TestInputLine(t *testing.T) {
+	tests := []struct {
+		text   string
+		cursor int
+		width  int
+		want   string
+		x      int
+	}{
+		{"hello", 5, 8, "hello", 5},
+		{"hello", 2, 8, "hello", 2},
+		{"hello world", 11, 8, "o world", 7},
+		{"hello world", 3, 8, "hello wo", 3},
+		{"hello world", 9, 8, "llo worl", 7},
+		{"世界你好", 4, 6, "你好", 4},
+		{"世界你好", 1, 6, "世界你", 2},
+	}
+	for _, test := range tests {
+		cells, x := inputLine([]rune(test.text), test.cursor, test.width)
+		if got := rows(cells, test.width)[0]; got != test.want || x != test.x {
+			t.Errorf("inputLine(%q, %d, %d) got %q %d, want %q %d", test.text, test.cursor, test.width, got, x, test.want, test.x)
+		}
+	}
+}
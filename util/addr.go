@@ -0,0 +1,56 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+//ParseAddr 将地址解析为net.Listen、net.Dial使用的network和address
+//支持"port"、":port"、"host:port"、"[::1]:port"，
+//以及带network前缀的"tcp4:host:port"、"tcp6:[::1]:port"、"unix:/path"
+func ParseAddr(addr string) (network, address string, err error) {
+	if len(addr) == 0 {
+		return "", "", errors.New("ParseAddr: addr is empty")
+	}
+	network, address = "tcp", addr
+	for _, n := range []string{"tcp", "tcp4", "tcp6", "unix"} {
+		if strings.HasPrefix(addr, n+":") {
+			network, address = n, addr[len(n)+1:]
+			break
+		}
+	}
+	if network == "unix" {
+		if len(address) == 0 {
+			return "", "", fmt.Errorf("ParseAddr: no socket path in %q", addr)
+		}
+		return network, address, nil
+	}
+	if strings.Trim(address, "0123456789") == "" {
+		address = ":" + address
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("ParseAddr: %v", err)
+	}
+	return network, address, nil
+}
+
+//DialAddr 本机连接监听地址a时使用的地址，格式可由ParseAddr解析
+//监听所有网卡时连接localhost
+func DialAddr(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	if a.Network() == "unix" {
+		return "unix:" + a.String()
+	}
+	host, port, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return a.String()
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}